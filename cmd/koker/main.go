@@ -1,8 +1,12 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
 
 	"github.com/google/go-containerregistry/pkg/name"
 	"github.com/pkg/errors"
@@ -13,7 +17,7 @@ import (
 	"github.com/ntk148v/koker/pkg/constants"
 	"github.com/ntk148v/koker/pkg/containers"
 	"github.com/ntk148v/koker/pkg/images"
-	"github.com/ntk148v/koker/pkg/network"
+	"github.com/ntk148v/koker/pkg/userns"
 	"github.com/ntk148v/koker/pkg/utils"
 )
 
@@ -29,8 +33,18 @@ func main() {
 	// colorized output because I like it!
 	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
 
-	if os.Getuid() != 0 {
-		log.Fatal().Msg("You need root privileges to run `koker`")
+	// A rootless child has to wait for its uid/gid mappings first
+	if err := userns.WaitForMappings(); err != nil {
+		log.Fatal().Err(err).Msg("Unable to setup user namespace")
+	}
+
+	if userns.Rootless() {
+		// Keep rootless state per user
+		home, err := userns.DataHome()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Unable to find rootless state directory")
+		}
+		constants.SetKokerHomePath(home)
 	}
 
 	if err := utils.InitKokerDirs(); err != nil {
@@ -48,6 +62,8 @@ func main() {
 			},
 		},
 		Usage: "Kien's mini Docker",
+		// Exit codes are handled once the image registry is saved
+		ExitErrHandler: func(*cli.Context, error) {},
 		Flags: []cli.Flag{
 			&cli.BoolFlag{
 				Name:    "quiet",
@@ -61,6 +77,11 @@ func main() {
 				Usage:   "Set log level to debug. You will see step-by-step what were executed",
 				Value:   false,
 			},
+			&cli.StringSliceFlag{
+				Name:    "default-ulimit",
+				Usage:   "Default ulimits for containers, in name=soft[:hard] format (e.g. nofile=1024:4096)",
+				EnvVars: []string{"KOKER_DEFAULT_ULIMIT"},
+			},
 		},
 		Before: func(ctx *cli.Context) error {
 			quiet := ctx.Bool("quiet")
@@ -92,29 +113,128 @@ func main() {
 			{
 				Name:      "run",
 				Usage:     "Run a command in a new container",
-				ArgsUsage: "IMAGE [COMMAND]",
+				ArgsUsage: "IMAGE [COMMAND] | --rootfs DIR [COMMAND]",
 				Flags: []cli.Flag{
 					&cli.StringFlag{
 						Name:  "hostname",
 						Usage: "Container hostname",
 					},
-					&cli.IntFlag{
-						Name:    "mem",
-						Aliases: []string{"m"},
-						Usage:   "Memory limit in MB",
-						Value:   -1,
+					&cli.StringSliceFlag{
+						Name:  "dns",
+						Usage: "Set custom DNS servers",
 					},
-					&cli.IntFlag{
+					&cli.StringSliceFlag{
+						Name:  "dns-search",
+						Usage: "Set custom DNS search domains",
+					},
+					&cli.StringSliceFlag{
+						Name:  "dns-option",
+						Usage: "Set DNS options",
+					},
+					&cli.StringSliceFlag{
+						Name:  "add-host",
+						Usage: "Add a custom host-to-IP mapping (host:ip)",
+					},
+					&cli.StringSliceFlag{
+						Name:  "sysctl",
+						Usage: "Set a namespaced kernel parameter (net.*, kernel.shm*, kernel.msg*, kernel.sem, fs.mqueue.*), in key=value format",
+					},
+					&cli.StringFlag{
+						Name:  "network",
+						Usage: "Network mode: bridge, none (loopback only), host or container:<id>",
+						Value: containers.NetworkBridge,
+					},
+					&cli.StringFlag{
+						Name:  "pid",
+						Usage: "PID namespace to use: host or container:<id>, a new one by default",
+					},
+					&cli.StringFlag{
+						Name:  "ipc",
+						Usage: "IPC namespace to use: host or container:<id>, a new one by default",
+					},
+					&cli.StringFlag{
+						Name:  "uts",
+						Usage: "UTS namespace to use: host or container:<id>, a new one by default",
+					},
+					&cli.StringFlag{
+						Name:  "cgroupns",
+						Usage: "Cgroup namespace to use: private or host",
+						Value: containers.CgroupnsPrivate,
+					},
+					&cli.BoolFlag{
+						Name:  "cgroup-delegate",
+						Usage: "Mount the container's cgroup read-write and let it manage sub-cgroups (cgroups v2 only)",
+					},
+					&cli.StringSliceFlag{
+						Name:  "time-offset",
+						Usage: "Offset the container's clocks in a time namespace, in clock=offset format (e.g. monotonic=+3600s,boottime=-1h)",
+					},
+					&cli.StringFlag{
+						Name:  "rootfs",
+						Usage: "Run from a root filesystem directory instead of an image, all arguments are the command",
+					},
+					&cli.StringFlag{
+						Name:  "rootfs-tar",
+						Usage: "Run from a root filesystem tarball (.tar or .tar.gz) instead of an image, all arguments are the command",
+					},
+					&cli.BoolFlag{
+						Name:  "read-only",
+						Usage: "Mount the container's root filesystem as read-only, /tmp and /run stay writable",
+					},
+					&cli.BoolFlag{
+						Name:  "privileged",
+						Usage: "Give the container the host's devices, a writable /sys and access to all devices",
+					},
+					&cli.StringSliceFlag{
+						Name:  "device",
+						Usage: "Add a host device to the container, in host[:container][:permissions] format (e.g. /dev/fuse or /dev/kvm:/dev/kvm:rw)",
+					},
+					&cli.StringSliceFlag{
+						Name:  "device-cgroup-rule",
+						Usage: "Allow access to devices in the device cgroup, in devices.allow format (e.g. 'c 10:200 rwm')",
+					},
+					&cli.StringSliceFlag{
+						Name:  "security-opt",
+						Usage: "Security options, in key=value format (e.g. landlock=profile.json to restrict the filesystem access)",
+					},
+					&cli.StringSliceFlag{
+						Name:  "tmpfs",
+						Usage: "Mount a tmpfs, in path[:options] format (e.g. /cache:size=64m,mode=1777,uid=1000,noexec)",
+					},
+					&cli.StringFlag{
+						Name:    "memory",
+						Aliases: []string{"mem", "m"},
+						Usage:   "Memory limit (e.g. 512m, 1.5g or max), in MB without unit",
+					},
+					&cli.StringFlag{
+						Name:  "memory-swap",
+						Usage: "Memory plus swap limit, max for unlimited swap (default: twice the memory limit)",
+					},
+					&cli.StringFlag{
 						Name:    "swap",
 						Aliases: []string{"sw"},
-						Usage:   "Swap limit in MB",
-						Value:   -1,
+						Usage:   "Swap limit on top of the memory limit, in MB without unit",
+					},
+					&cli.StringFlag{
+						Name:  "memory-reservation",
+						Usage: "Memory soft limit (e.g. 256m), memory.low on cgroup v2",
+					},
+					&cli.StringFlag{
+						Name:  "memory-high",
+						Usage: "Memory usage above which the container is throttled, cgroup v2 only",
 					},
-					&cli.Float64Flag{
+					&cli.IntFlag{
+						Name:  "memory-swappiness",
+						Usage: "Tendency to swap the container's memory (0 to 100), cgroup v1 only",
+					},
+					&cli.BoolFlag{
+						Name:  "oom-kill-disable",
+						Usage: "Disable the OOM killer, processes wait for memory instead, cgroup v1 only",
+					},
+					&cli.StringFlag{
 						Name:    "cpus",
 						Aliases: []string{"c"},
-						Usage:   "Number of CPU cores to restrict to",
-						Value:   -1.0,
+						Usage:   "Number of CPUs to restrict to (e.g. 0.25 or 1.5)",
 					},
 					&cli.IntFlag{
 						Name:    "pids",
@@ -122,31 +242,124 @@ func main() {
 						Usage:   "Number of max processes to allow",
 						Value:   -1,
 					},
+					&cli.StringFlag{
+						Name:  "cpuset-cpus",
+						Usage: "CPUs in which to allow execution (e.g. 0-3 or 0,1)",
+					},
+					&cli.StringFlag{
+						Name:  "cpuset-mems",
+						Usage: "Memory nodes in which to allow execution (e.g. 0-3 or 0,1)",
+					},
+					&cli.Uint64Flag{
+						Name:  "cpu-shares",
+						Usage: "CPU shares, the relative CPU weight as on cgroup v1 (2 to 262144)",
+					},
+					&cli.Uint64Flag{
+						Name:  "cpu-weight",
+						Usage: "Relative CPU weight as on cgroup v2 (1 to 10000)",
+					},
+					&cli.Int64Flag{
+						Name:  "cpu-period",
+						Usage: "CFS period in microseconds (1000 to 1000000)",
+					},
+					&cli.Int64Flag{
+						Name:  "cpu-quota",
+						Usage: "CFS quota in microseconds per period, -1 for unlimited",
+					},
+					&cli.UintFlag{
+						Name:  "blkio-weight",
+						Usage: "Relative block I/O weight (10 to 1000)",
+					},
+					&cli.StringSliceFlag{
+						Name:  "device-read-bps",
+						Usage: "Limit the read rate from a block device, in path:rate format (e.g. /dev/sda:10mb)",
+					},
+					&cli.StringSliceFlag{
+						Name:  "device-write-bps",
+						Usage: "Limit the write rate to a block device, in path:rate format (e.g. /dev/sda:10mb)",
+					},
+					&cli.StringSliceFlag{
+						Name:  "device-read-iops",
+						Usage: "Limit the read operations per second from a block device, in path:rate format (e.g. /dev/sda:1000)",
+					},
+					&cli.StringSliceFlag{
+						Name:  "device-write-iops",
+						Usage: "Limit the write operations per second to a block device, in path:rate format (e.g. /dev/sda:1000)",
+					},
+					&cli.StringSliceFlag{
+						Name:  "ulimit",
+						Usage: "Ulimit of the container processes, in name=soft[:hard] format (e.g. nofile=1024:4096)",
+					},
+					&cli.IntFlag{
+						Name:  "oom-score-adj",
+						Usage: "Tune the container processes' OOM score adjustment (-1000 to 1000)",
+					},
+					&cli.StringFlag{
+						Name:  "health-cmd",
+						Usage: "Command to run to check health, with the container's shell",
+					},
+					&cli.DurationFlag{
+						Name:  "health-interval",
+						Usage: "Time between running the health check (default 30s)",
+					},
+					&cli.DurationFlag{
+						Name:  "health-timeout",
+						Usage: "Maximum time to allow one health check to run (default 30s)",
+					},
+					&cli.DurationFlag{
+						Name:  "health-start-period",
+						Usage: "Start period for the container to initialize before failed health checks count",
+					},
+					&cli.IntFlag{
+						Name:  "health-retries",
+						Usage: "Consecutive failures needed to report unhealthy (default 3)",
+					},
+					&cli.BoolFlag{
+						Name:  "no-healthcheck",
+						Usage: "Disable the image's health check",
+					},
+					&cli.BoolFlag{
+						Name:    "detach",
+						Aliases: []string{"d"},
+						Usage:   "Run the container in the background and print its ID",
+					},
+					&cli.BoolFlag{
+						Name:  "report",
+						Usage: "Print a summary of the container's resource usage when it exits",
+					},
+					&cli.StringFlag{
+						Name:  "restart",
+						Usage: "Restart policy of a detached container: no, on-failure[:max-retries], always or unless-stopped",
+						Value: containers.RestartNo,
+					},
 				},
 				Action: func(ctx *cli.Context) error {
-					// Create and setup network bridge
-					if ok, _ := network.CheckBridgeUp(constants.KokerBridgeName); !ok {
-						if err := network.SetupBridge(constants.KokerBridgeName,
-							constants.KokerBridgeDefaultIP+"/16"); err != nil {
-							return errors.Wrap(err, "unable to create default bridge")
-						}
+					args := ctx.Args()
+					rootfs, rootfsTar := ctx.String("rootfs"), ctx.String("rootfs-tar")
+					if rootfs != "" && rootfsTar != "" {
+						return errors.New("--rootfs and --rootfs-tar are mutually exclusive")
 					}
 
-					// Setup iptables rules for outgoing traffic
-					if err := network.AppendPOSTROUTINGRule(constants.KokerBridgeIPCIDR,
-						constants.KokerBridgeName); err != nil {
-						return errors.Wrap(err, "unable to setup iptables rules")
+					// Without image, every argument is part of the command
+					var (
+						image    string
+						commands []string
+					)
+					if rootfs == "" && rootfsTar == "" {
+						if !args.Present() {
+							return errors.New("missing required arguments")
+						}
+						image = args.Get(0)
+						if len(args.Slice()) >= 2 {
+							commands = args.Slice()[1:]
+						}
+					} else {
+						commands = args.Slice()
 					}
 
-					args := ctx.Args()
-					if !args.Present() {
-						return errors.New("missing required arguments")
-					}
-					image := args.Get(0)
-
-					var commands []string
-					if len(args.Slice()) >= 2 {
-						commands = args.Slice()[1:]
+					hc, err := newHostConfig(ctx, image)
+					if err != nil {
+						return err
 					}
 
 					c, err := containers.NewContainer(utils.GenUID())
@@ -154,47 +367,22 @@ func main() {
 						return fmt.Errorf("error initializing container: %v", err)
 					}
 
-					// Init container
-					if err := c.Run(image, commands, ctx.String("hostname"), ctx.Int("mem"), ctx.Int("swap"),
-						ctx.Int("pids"), ctx.Float64("cpus"), ctx.Bool("quiet"), ctx.Bool("debug")); err != nil {
-						return fmt.Errorf("error initializing container: %v", err)
+					// A detached container is run by its monitor
+					if hc.Detach {
+						if err := c.Detach(hc, commands, ctx.Bool("quiet"), ctx.Bool("debug")); err != nil {
+							return fmt.Errorf("error initializing container: %v", err)
+						}
+						fmt.Println(c.ID)
+						return nil
 					}
-					return nil
+
+					// Init container, koker exits with the container's command
+					return exitCode(c.Run(hc, commands, ctx.Bool("quiet"), ctx.Bool("debug")))
 				},
 			},
 			{
 				Name:     "child",
 				HideHelp: true,
-				Flags: []cli.Flag{
-					&cli.StringFlag{
-						Name:  "hostname",
-						Usage: "Container hostname",
-					},
-					&cli.IntFlag{
-						Name:    "mem",
-						Aliases: []string{"m"},
-						Usage:   "Memory limit in MB",
-						Value:   -1,
-					},
-					&cli.IntFlag{
-						Name:    "swap",
-						Aliases: []string{"sw"},
-						Usage:   "Swap limit in MB",
-						Value:   -1,
-					},
-					&cli.Float64Flag{
-						Name:    "cpus",
-						Aliases: []string{"c"},
-						Usage:   "Number of CPU cores to restrict to",
-						Value:   -1.0,
-					},
-					&cli.IntFlag{
-						Name:    "pids",
-						Aliases: []string{"p"},
-						Usage:   "Number of max processes to allow",
-						Value:   -1,
-					},
-				},
 				Action: func(ctx *cli.Context) error {
 					args := ctx.Args()
 					container := args.Get(0)
@@ -214,16 +402,141 @@ func main() {
 					}
 
 					// Run child command
-					if err := c.RunChild(commands, ctx.String("hostname"), ctx.Int("mem"), ctx.Int("swap"),
-						ctx.Int("pids"), ctx.Float64("cpus")); err != nil {
-						return errors.Wrap(err, "error running child command")
+					if err := c.RunChild(commands); err != nil {
+						return exitCode(errors.Wrap(err, "error running child command"))
+					}
+					return nil
+				},
+			},
+			{
+				Name:     "monitor",
+				HideHelp: true,
+				Hidden:   true,
+				Action: func(ctx *cli.Context) error {
+					c, err := containers.NewContainer(ctx.Args().Get(0))
+					if err != nil {
+						return fmt.Errorf("error initializing container: %v", err)
+					}
+					return exitCode(c.Monitor(ctx.Bool("quiet"), ctx.Bool("debug")))
+				},
+			},
+			{
+				Name:     "remove-dir",
+				HideHelp: true,
+				Hidden:   true,
+				Action: func(ctx *cli.Context) error {
+					if err := containers.RemoveDir(ctx.Args().Get(0)); err != nil {
+						fmt.Fprintln(os.Stderr, err)
+						return cli.Exit("", 1)
 					}
 					return nil
 				},
 			},
+			{
+				Name:     "healthcheck",
+				HideHelp: true,
+				Hidden:   true,
+				Action: func(ctx *cli.Context) error {
+					c, err := containers.NewContainer(ctx.Args().Get(0))
+					if err != nil {
+						return cli.Exit(err, 1)
+					}
+					if err := c.LoadConfig(); err != nil {
+						return cli.Exit(err, 1)
+					}
+
+					// The exit code is the health check's result
+					return exitCode(c.ExecuteHealthcheck())
+				},
+			},
+			{
+				Name:      "start",
+				Usage:     "Start a stopped detached container",
+				ArgsUsage: "CONTAINER | --all-restartable",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "all-restartable",
+						Usage: "Start the containers whose restart policy asks for it, after a reboot for instance",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					if ctx.Bool("all-restartable") {
+						return containers.StartRestartable(ctx.Bool("quiet"), ctx.Bool("debug"))
+					}
+					args := ctx.Args()
+					if !args.Present() {
+						return errors.New("missing required arguments")
+					}
+
+					c, err := containers.NewContainer(args.Get(0))
+					if err != nil {
+						return fmt.Errorf("error initializing container: %v", err)
+					}
+					return c.Start(ctx.Bool("quiet"), ctx.Bool("debug"))
+				},
+			},
+			{
+				Name:      "stop",
+				Usage:     "Stop a running container",
+				ArgsUsage: "CONTAINER",
+				Flags: []cli.Flag{
+					&cli.DurationFlag{
+						Name:    "time",
+						Aliases: []string{"t"},
+						Usage:   "Time to wait for the container to stop before killing it",
+						Value:   10 * time.Second,
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					args := ctx.Args()
+					if !args.Present() {
+						return errors.New("missing required arguments")
+					}
+
+					c, err := containers.NewContainer(args.Get(0))
+					if err != nil {
+						return fmt.Errorf("error initializing container: %v", err)
+					}
+					return c.Stop(ctx.Duration("time"))
+				},
+			},
+			{
+				Name:      "pause",
+				Usage:     "Pause all processes within a container",
+				ArgsUsage: "CONTAINER",
+				Action: func(ctx *cli.Context) error {
+					args := ctx.Args()
+					if !args.Present() {
+						return errors.New("missing required arguments")
+					}
+
+					c, err := containers.NewContainer(args.Get(0))
+					if err != nil {
+						return fmt.Errorf("error initializing container: %v", err)
+					}
+					return c.Pause()
+				},
+			},
+			{
+				Name:      "unpause",
+				Usage:     "Unpause all processes within a container",
+				ArgsUsage: "CONTAINER",
+				Action: func(ctx *cli.Context) error {
+					args := ctx.Args()
+					if !args.Present() {
+						return errors.New("missing required arguments")
+					}
+
+					c, err := containers.NewContainer(args.Get(0))
+					if err != nil {
+						return fmt.Errorf("error initializing container: %v", err)
+					}
+					return c.Unpause()
+				},
+			},
 			{
 				Name:      "rm",
-				Usage:     "Remove a container (WIP)",
+				Usage:     "Remove a container",
 				HideHelp:  true,
 				ArgsUsage: "CONTAINER",
 				Flags: []cli.Flag{
@@ -235,23 +548,229 @@ func main() {
 					},
 				},
 				Action: func(ctx *cli.Context) error {
+					args := ctx.Args()
+					if !args.Present() {
+						return errors.New("missing required arguments")
+					}
+
 					// Remove container
-					return nil
+					c, err := containers.NewContainer(args.Get(0))
+					if err != nil {
+						return fmt.Errorf("error initializing container: %v", err)
+					}
+					return c.Remove(ctx.Bool("force"))
 				},
 			},
 			{
 				Name:  "ls",
 				Usage: "List running containers",
-				Flags: []cli.Flag{},
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:    "all",
+						Aliases: []string{"a"},
+						Usage:   "Show all containers, exited ones included",
+					},
+				},
 				Action: func(ctx *cli.Context) error {
 					// List all running containers
-					cs, err := containers.ListAllContainers()
+					cs, err := containers.ListAllContainers(ctx.Bool("all"))
 					if err != nil {
 						return errors.Wrap(err, "unable to list all containers")
 					}
 					return utils.GenTemplate("container", constants.ContainersTemplate, cs)
 				},
 			},
+			{
+				Name:      "inspect",
+				Usage:     "Display detailed information on one or more containers",
+				ArgsUsage: "CONTAINER [CONTAINER...]",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "format",
+						Aliases: []string{"f"},
+						Usage:   "Format the output using the given Go template (e.g. '{{.State.Status}}' or '{{json .NetworkSettings}}')",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					args := ctx.Args()
+					if !args.Present() {
+						return errors.New("missing required arguments")
+					}
+
+					var inspects []*containers.Inspect
+					for _, id := range args.Slice() {
+						c, err := containers.NewContainer(id)
+						if err != nil {
+							return fmt.Errorf("error initializing container: %v", err)
+						}
+						inspect, err := c.Inspect()
+						if err != nil {
+							return errors.Wrapf(err, "unable to inspect container %s", id)
+						}
+						inspects = append(inspects, inspect)
+					}
+
+					if format := ctx.String("format"); format != "" {
+						for _, inspect := range inspects {
+							if err := utils.FormatTemplate(format, inspect); err != nil {
+								return err
+							}
+						}
+						return nil
+					}
+					b, err := json.MarshalIndent(inspects, "", "    ")
+					if err != nil {
+						return err
+					}
+					fmt.Println(string(b))
+					return nil
+				},
+			},
+			{
+				Name:      "top",
+				Usage:     "Display the running processes of a container",
+				ArgsUsage: "CONTAINER [ps OPTIONS]",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "tree",
+						Usage: "Show the processes as a tree, children under their parent",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					args := ctx.Args()
+					if !args.Present() {
+						return errors.New("missing required arguments")
+					}
+
+					c, err := containers.NewContainer(args.Get(0))
+					if err != nil {
+						return fmt.Errorf("error initializing container: %v", err)
+					}
+					// With ps options, the host's ps lists the processes
+					if psArgs := args.Tail(); len(psArgs) > 0 {
+						if ctx.Bool("tree") {
+							return errors.New("--tree can't be used with ps options")
+						}
+						out, err := c.TopPs(psArgs)
+						if err != nil {
+							return err
+						}
+						fmt.Print(out)
+						return nil
+					}
+
+					ps, err := c.Top(ctx.Bool("tree"))
+					if err != nil {
+						return errors.Wrap(err, "unable to list container processes")
+					}
+					return utils.GenTemplate("top", constants.ProcessesTemplate, ps)
+				},
+			},
+			{
+				Name:      "stats",
+				Usage:     "Display a live stream of containers resource usage statistics",
+				ArgsUsage: "[CONTAINER...]",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "no-stream",
+						Usage: "Display the statistics once instead of refreshing them",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					stream := !ctx.Bool("no-stream")
+					return containers.WatchStats(ctx.Args().Slice(), stream, func(stats []map[string]string) error {
+						if stream {
+							// Clear the terminal before refreshing the table
+							fmt.Print("\033[H\033[2J")
+						}
+						return utils.GenTemplate("stats", constants.StatsTemplate, stats)
+					})
+				},
+			},
+			{
+				Name:      "update",
+				Usage:     "Update the resource limits of a container",
+				ArgsUsage: "CONTAINER",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "memory",
+						Aliases: []string{"m"},
+						Usage:   "Memory limit (e.g. 512m, 1.5g or max), in MB without unit",
+					},
+					&cli.StringFlag{
+						Name:  "memory-swap",
+						Usage: "Memory plus swap limit, max for unlimited swap",
+					},
+					&cli.StringFlag{
+						Name:  "memory-reservation",
+						Usage: "Memory soft limit (e.g. 256m), memory.low on cgroup v2",
+					},
+					&cli.StringFlag{
+						Name:  "memory-high",
+						Usage: "Memory usage above which the container is throttled, cgroup v2 only",
+					},
+					&cli.IntFlag{
+						Name:  "memory-swappiness",
+						Usage: "Tendency to swap the container's memory (0 to 100), cgroup v1 only",
+					},
+					&cli.StringFlag{
+						Name:  "cpus",
+						Usage: "Number of CPUs to restrict to (e.g. 0.25, 1.5 or max)",
+					},
+					&cli.IntFlag{
+						Name:  "pids-limit",
+						Usage: "Number of max processes to allow, 0 or -1 for unlimited",
+					},
+					&cli.StringFlag{
+						Name:  "cpuset-cpus",
+						Usage: "CPUs in which to allow execution (e.g. 0-3 or 0,1)",
+					},
+					&cli.StringFlag{
+						Name:  "cpuset-mems",
+						Usage: "Memory nodes in which to allow execution (e.g. 0-3 or 0,1)",
+					},
+					&cli.Uint64Flag{
+						Name:  "cpu-shares",
+						Usage: "CPU shares, the relative CPU weight as on cgroup v1 (2 to 262144)",
+					},
+					&cli.Uint64Flag{
+						Name:  "cpu-weight",
+						Usage: "Relative CPU weight as on cgroup v2 (1 to 10000)",
+					},
+					&cli.Int64Flag{
+						Name:  "cpu-period",
+						Usage: "CFS period in microseconds (1000 to 1000000)",
+					},
+					&cli.Int64Flag{
+						Name:  "cpu-quota",
+						Usage: "CFS quota in microseconds per period, -1 for unlimited",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					args := ctx.Args()
+					if !args.Present() {
+						return errors.New("missing required arguments")
+					}
+
+					c, err := containers.NewContainer(args.Get(0))
+					if err != nil {
+						return fmt.Errorf("error initializing container: %v", err)
+					}
+					return c.Update(func(hc *containers.HostConfig) error {
+						if err := parseMemoryLimits(ctx, hc); err != nil {
+							return err
+						}
+						if ctx.IsSet("pids-limit") {
+							// 0 would leave the limit unchanged
+							hc.Pids = ctx.Int("pids-limit")
+							if hc.Pids == 0 {
+								hc.Pids = -1
+							}
+						}
+						return parseCPULimits(ctx, hc)
+					})
+				},
+			},
 			{
 				Name:  "exec",
 				Usage: "Run a command inside a running container",
@@ -356,6 +875,226 @@ func main() {
 		imageCmd,
 	}
 	if err := app.Run(os.Args); err != nil {
+		var exitErr cli.ExitCoder
+		if errors.As(err, &exitErr) {
+			// Deferred calls don't run on exit
+			images.SaveRepository()
+			os.Exit(exitErr.ExitCode())
+		}
 		log.Error().Err(err).Msg("Something went wrong")
 	}
 }
+
+// parseMemoryLimits sets the host config memory and swap limits from
+// --memory and --memory-swap, the total of memory and swap, and the
+// other memory options
+func parseMemoryLimits(ctx *cli.Context, hc *containers.HostConfig) error {
+	var err error
+	memory, memorySwap := hc.Memory, containers.Bytes(0)
+	if ctx.IsSet("memory") {
+		if memory, err = containers.ParseBytes(ctx.String("memory")); err != nil {
+			return err
+		}
+	}
+	if ctx.IsSet("memory-swap") {
+		if memorySwap, err = containers.ParseBytes(ctx.String("memory-swap")); err != nil {
+			return err
+		}
+	}
+	if ctx.IsSet("memory") || ctx.IsSet("memory-swap") {
+		if err := hc.SetMemory(memory, memorySwap); err != nil {
+			return err
+		}
+	}
+	if ctx.IsSet("memory-reservation") {
+		if hc.MemoryReservation, err = containers.ParseBytes(ctx.String("memory-reservation")); err != nil {
+			return err
+		}
+	}
+	if ctx.IsSet("memory-high") {
+		if hc.MemoryHigh, err = containers.ParseBytes(ctx.String("memory-high")); err != nil {
+			return err
+		}
+	}
+	if ctx.IsSet("memory-swappiness") {
+		swappiness := ctx.Int("memory-swappiness")
+		hc.MemorySwappiness = &swappiness
+	}
+	return nil
+}
+
+// parseCPULimits sets the host config CPU limits from --cpus, the CFS
+// quota and period, the CPU weight and the cpusets. Each replaces the
+// options it is exclusive with, which a container update may have set.
+func parseCPULimits(ctx *cli.Context, hc *containers.HostConfig) error {
+	if ctx.IsSet("cpus") && (ctx.IsSet("cpu-period") || ctx.IsSet("cpu-quota")) {
+		return errors.New("--cpus and --cpu-period or --cpu-quota are exclusive")
+	}
+	if ctx.IsSet("cpu-shares") && ctx.IsSet("cpu-weight") {
+		return errors.New("--cpu-shares and --cpu-weight are exclusive")
+	}
+	if ctx.IsSet("cpus") {
+		cpus, err := containers.ParseCPUs(ctx.String("cpus"))
+		if err != nil {
+			return err
+		}
+		hc.CPUs, hc.CPUPeriod, hc.CPUQuota = cpus, 0, 0
+	}
+	if ctx.IsSet("cpu-period") || ctx.IsSet("cpu-quota") {
+		hc.CPUs = 0
+		if ctx.IsSet("cpu-period") {
+			hc.CPUPeriod = ctx.Int64("cpu-period")
+		}
+		if ctx.IsSet("cpu-quota") {
+			hc.CPUQuota = ctx.Int64("cpu-quota")
+		}
+	}
+	if ctx.IsSet("cpu-shares") {
+		hc.CPUShares, hc.CPUWeight = ctx.Uint64("cpu-shares"), 0
+	}
+	if ctx.IsSet("cpu-weight") {
+		hc.CPUWeight, hc.CPUShares = ctx.Uint64("cpu-weight"), 0
+	}
+	if ctx.IsSet("cpuset-cpus") {
+		hc.CpusetCPUs = ctx.String("cpuset-cpus")
+	}
+	if ctx.IsSet("cpuset-mems") {
+		hc.CpusetMems = ctx.String("cpuset-mems")
+	}
+	return nil
+}
+
+// newHostConfig returns the host config of a new container
+// from `container run` options
+func newHostConfig(ctx *cli.Context, image string) (*containers.HostConfig, error) {
+	hc := containers.NewHostConfig(image)
+	hc.Hostname = ctx.String("hostname")
+	if err := parseMemoryLimits(ctx, hc); err != nil {
+		return nil, err
+	}
+	if ctx.IsSet("swap") {
+		if ctx.IsSet("memory-swap") {
+			return nil, errors.New("--swap and --memory-swap are exclusive")
+		}
+		swap, err := containers.ParseBytes(ctx.String("swap"))
+		if err != nil {
+			return nil, err
+		}
+		hc.Swap = swap
+	}
+	hc.Pids = ctx.Int("pids")
+	if err := parseCPULimits(ctx, hc); err != nil {
+		return nil, err
+	}
+	hc.OOMKillDisable = ctx.Bool("oom-kill-disable")
+	hc.BlkioWeight = uint16(ctx.Uint("blkio-weight"))
+	for _, throttle := range []struct {
+		flag    string
+		bytes   bool
+		devices *[]containers.ThrottleDevice
+	}{
+		{"device-read-bps", true, &hc.DeviceReadBps},
+		{"device-write-bps", true, &hc.DeviceWriteBps},
+		{"device-read-iops", false, &hc.DeviceReadIOps},
+		{"device-write-iops", false, &hc.DeviceWriteIOps},
+	} {
+		devices, err := containers.ParseThrottleDevices(ctx.StringSlice(throttle.flag), throttle.bytes)
+		if err != nil {
+			return nil, err
+		}
+		*throttle.devices = devices
+	}
+	hc.ReadOnly = ctx.Bool("read-only")
+	hc.Privileged = ctx.Bool("privileged")
+	hc.DNS = ctx.StringSlice("dns")
+	hc.DNSSearch = ctx.StringSlice("dns-search")
+	hc.DNSOptions = ctx.StringSlice("dns-option")
+	hc.ExtraHosts = ctx.StringSlice("add-host")
+	hc.NetworkMode = ctx.String("network")
+	hc.PidMode = ctx.String("pid")
+	hc.IpcMode = ctx.String("ipc")
+	hc.UTSMode = ctx.String("uts")
+	hc.CgroupnsMode = ctx.String("cgroupns")
+	hc.CgroupDelegate = ctx.Bool("cgroup-delegate")
+
+	if rootfs := ctx.String("rootfs"); rootfs != "" {
+		rootfs, err := filepath.Abs(rootfs)
+		if err != nil {
+			return nil, err
+		}
+		hc.RootFSPath = rootfs
+	}
+	if rootfsTar := ctx.String("rootfs-tar"); rootfsTar != "" {
+		rootfsTar, err := filepath.Abs(rootfsTar)
+		if err != nil {
+			return nil, err
+		}
+		hc.RootFSTar = rootfsTar
+	}
+
+	// Container ulimits override the default ones
+	defaultUlimits, err := containers.ParseUlimits(ctx.StringSlice("default-ulimit"))
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid default ulimit")
+	}
+	ulimits, err := containers.ParseUlimits(ctx.StringSlice("ulimit"))
+	if err != nil {
+		return nil, err
+	}
+	hc.Ulimits = containers.MergeUlimits(defaultUlimits, ulimits)
+
+	if ctx.IsSet("oom-score-adj") {
+		oomScoreAdj := ctx.Int("oom-score-adj")
+		if oomScoreAdj < -1000 || oomScoreAdj > 1000 {
+			return nil, errors.Errorf("invalid OOM score adjustment %d, must be between -1000 and 1000", oomScoreAdj)
+		}
+		hc.OomScoreAdj = &oomScoreAdj
+	}
+
+	if hc.Tmpfs, err = containers.ParseTmpfsMounts(ctx.StringSlice("tmpfs")); err != nil {
+		return nil, err
+	}
+	if hc.Sysctls, err = containers.ParseSysctls(ctx.StringSlice("sysctl")); err != nil {
+		return nil, err
+	}
+	if hc.Devices, err = containers.ParseDevices(ctx.StringSlice("device")); err != nil {
+		return nil, err
+	}
+	hc.DeviceCgroupRules = ctx.StringSlice("device-cgroup-rule")
+	if err := hc.ParseSecurityOpts(ctx.StringSlice("security-opt")); err != nil {
+		return nil, err
+	}
+	hc.NoHealthcheck = ctx.Bool("no-healthcheck")
+	for _, flag := range []string{"health-cmd", "health-interval", "health-timeout",
+		"health-start-period", "health-retries"} {
+		if ctx.IsSet(flag) {
+			hc.Healthcheck = containers.NewHealthConfig(ctx.String("health-cmd"),
+				ctx.Duration("health-interval"), ctx.Duration("health-timeout"),
+				ctx.Duration("health-start-period"), ctx.Int("health-retries"))
+			break
+		}
+	}
+	if hc.TimeOffsets, err = containers.ParseTimeOffsets(ctx.StringSlice("time-offset")); err != nil {
+		return nil, err
+	}
+	hc.Detach = ctx.Bool("detach")
+	hc.Report = ctx.Bool("report")
+	if hc.RestartPolicy, err = containers.ParseRestartPolicy(ctx.String("restart")); err != nil {
+		return nil, err
+	}
+	return hc, hc.Validate()
+}
+
+// exitCode makes koker exit with the status of the container's command,
+// other errors are logged and koker exits with 1
+func exitCode(err error) error {
+	if err == nil {
+		return nil
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return cli.Exit("", containers.ExitStatus(exitErr))
+	}
+	log.Error().Err(err).Msg("Something went wrong")
+	return cli.Exit("", 1)
+}
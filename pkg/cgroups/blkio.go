@@ -0,0 +1,63 @@
+package cgroups
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// Block I/O weights range, as cgroup v1 blkio.weight
+const (
+	MinBlkioWeight = 10
+	MaxBlkioWeight = 1000
+)
+
+// BlkioWeightToIOWeight converts a cgroup v1 block I/O weight to a
+// cgroup v2 io.weight, 1 to 10000, mapping their ranges linearly like
+// runc does. 0 is unset.
+func BlkioWeightToIOWeight(weight uint16) uint64 {
+	if weight == 0 {
+		return 0
+	}
+	return 1 + (uint64(weight)-MinBlkioWeight)*9999/(MaxBlkioWeight-MinBlkioWeight)
+}
+
+// ThrottleDevice is the rate limit of a block device, in bytes or
+// operations per second. 0 removes the limit.
+type ThrottleDevice struct {
+	Major int64
+	Minor int64
+	Rate  uint64
+}
+
+// String returns the throttle in cgroup v1 blkio.throttle format
+func (d ThrottleDevice) String() string {
+	return fmt.Sprintf("%d:%d %d", d.Major, d.Minor, d.Rate)
+}
+
+// BlkioThrottle are the rate limits of block devices
+type BlkioThrottle struct {
+	ReadBps   []ThrottleDevice
+	WriteBps  []ThrottleDevice
+	ReadIOPS  []ThrottleDevice
+	WriteIOPS []ThrottleDevice
+}
+
+// writeWeight writes weight to file in dir, which exists if the I/O
+// scheduler supports weights
+func writeWeight(dir, file string, weight uint64) error {
+	path := filepath.Join(dir, file)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return errors.Errorf("unable to set the block I/O weight, no %s: "+
+			"the I/O scheduler doesn't support weights", file)
+	}
+	return writeLimit(path, int64(weight), "")
+}
+
+// fileExists reports whether a cgroup file exists
+func fileExists(dir, file string) bool {
+	_, err := os.Stat(filepath.Join(dir, file))
+	return err == nil
+}
@@ -1,20 +1,75 @@
 package cgroups
 
 import (
+	"bufio"
+	"os"
 	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/pkg/errors"
 	"golang.org/x/sys/unix"
 
 	"github.com/ntk148v/koker/pkg/constants"
+	"github.com/ntk148v/koker/pkg/filesystem"
+	"github.com/ntk148v/koker/pkg/userns"
 )
 
+// Unlimited is the value of a limit removed, "max" in cgroup files
+const Unlimited = -1
+
+// The limits of CGroups are left unchanged when 0, and removed when
+// Unlimited, but the swap one.
 type CGroups interface {
-	// SetMemSwpLimit sets memory and swap limit for CGroups
-	SetMemSwpLimit(memory, swap int) error
+	// Create creates the CGroups, the other methods expect it to exist
+	Create() error
+	// SetMemSwpLimit sets memory and swap limit for CGroups, in bytes.
+	// swap is the swap allowed on top of memory: 0 for none, Unlimited
+	// for no limit. Nothing changes when memory is 0, and swap is
+	// unlimited when memory is.
+	SetMemSwpLimit(memory, swap int64) error
+	// SetMemoryReservation sets the memory soft limit of the CGroups,
+	// protected from reclaim on cgroups v2
+	SetMemoryReservation(reservation int64) error
+	// SetMemoryHigh sets the memory usage above which the CGroups is
+	// throttled, only on cgroups v2
+	SetMemoryHigh(high int64) error
+	// SetMemorySwappiness sets the tendency to swap the CGroups
+	// memory, only on cgroups v1. A negative one is unchanged.
+	SetMemorySwappiness(swappiness int) error
+	// SetOOMKillDisable disables the OOM killer for the CGroups, its
+	// processes wait for memory instead, only on cgroups v1
+	SetOOMKillDisable(disable bool) error
 	// SetPidsLimit sets maximum processes than can be created
 	SetPidsLimit(pids int) error
-	// SetCPULimit  sets number of CPU for the CGroups
+	// SetCPULimit  sets number of CPU for the CGroups, possibly
+	// fractional
 	SetCPULimit(cpus float64) error
+	// SetCPUQuota sets the CFS quota of the CGroups, the CPU time
+	// in microseconds it can use every period, in microseconds too
+	SetCPUQuota(quota, period int64) error
+	// SetCPUShares sets the relative CPU weight of the CGroups as
+	// cgroup v1 shares, converted to a weight on cgroups v2
+	SetCPUShares(shares uint64) error
+	// SetCPUWeight sets the relative CPU weight of the CGroups as a
+	// cgroup v2 weight, converted to shares on cgroups v1
+	SetCPUWeight(weight uint64) error
+	// SetCpusetCPUs restricts the CGroups to a list of CPUs,
+	// such as 0-2,4. An empty list keeps the current one.
+	SetCpusetCPUs(cpus string) error
+	// SetCpusetMems restricts the CGroups to a list of memory
+	// nodes. An empty list keeps the current one.
+	SetCpusetMems(mems string) error
+	// SetBlkioWeight sets the relative block I/O weight of the
+	// CGroups, 10 to 1000, converted to an io.weight on cgroups v2
+	SetBlkioWeight(weight uint16) error
+	// SetBlkioThrottle sets the rate limits of block devices
+	SetBlkioThrottle(throttle BlkioThrottle) error
+	// SetDeviceRules denies access to all devices but the ones
+	// allowed by the rules
+	SetDeviceRules(rules []DeviceRule) error
 	// AddProcess adds a pid into a CGroup.
 	AddProcess() error
 	// Remove removes CGroups
@@ -22,9 +77,128 @@ type CGroups interface {
 	Remove()
 	// GetPids returns slice of pids running on CGroups
 	GetPids() ([]string, error)
+	// Mount mounts the cgroup filesystems at target. From a cgroup
+	// namespace, only the CGroups and its descendants are visible.
+	Mount(target string, readOnly bool) (filesystem.Unmounter, error)
+	// Delegate moves the process to a leaf of the CGroups, so that
+	// the CGroups subtree can be managed from inside the container.
+	Delegate() error
+	// Freeze suspends the processes of the CGroups, until they are frozen
+	Freeze() error
+	// Thaw resumes the processes of a frozen CGroups
+	Thaw() error
+	// Frozen reports whether the CGroups is frozen
+	Frozen() (bool, error)
+	// OOMKillCount returns the number of processes of the CGroups
+	// killed by the OOM killer
+	OOMKillCount() (int, error)
+	// Paths returns the CGroups directories by controller, the
+	// unified hierarchy has a single "unified" one.
+	Paths() map[string]string
+	// Stats returns the resource usage of the CGroups
+	Stats() (*Stats, error)
+	// MemorySettings returns the effective memory settings of the CGroups
+	MemorySettings() (*MemorySettings, error)
+}
+
+// minCPUQuota is the lowest CFS quota the kernel accepts, in microseconds
+const minCPUQuota = 1000
+
+// cpuQuota returns the CFS quota of cpus in microseconds per
+// DefaultCfsPeriod, Unlimited for a negative cpus
+func cpuQuota(cpus float64) int64 {
+	if cpus < 0 {
+		return Unlimited
+	}
+	quota := int64(cpus * constants.DefaultCfsPeriod)
+	if quota < minCPUQuota {
+		quota = minCPUQuota
+	}
+	return quota
+}
+
+// CPU shares of cgroups v1 and weights of cgroups v2 ranges
+const (
+	MinCPUShares = 2
+	MaxCPUShares = 262144
+	MinCPUWeight = 1
+	MaxCPUWeight = 10000
+)
+
+// SharesToWeight converts cgroup v1 CPU shares to a cgroup v2 CPU
+// weight, mapping their ranges linearly like runc does. 0 is unset.
+func SharesToWeight(shares uint64) uint64 {
+	if shares == 0 {
+		return 0
+	}
+	return MinCPUWeight + (shares-MinCPUShares)*(MaxCPUWeight-MinCPUWeight)/(MaxCPUShares-MinCPUShares)
+}
+
+// WeightToShares converts a cgroup v2 CPU weight to cgroup v1 CPU
+// shares, the inverse of SharesToWeight. 0 is unset.
+func WeightToShares(weight uint64) uint64 {
+	if weight == 0 {
+		return 0
+	}
+	return MinCPUShares + (weight-MinCPUWeight)*(MaxCPUShares-MinCPUShares)/(MaxCPUWeight-MinCPUWeight)
+}
+
+// formatLimit formats a limit for a cgroup file, max for Unlimited
+func formatLimit(limit int64, max string) string {
+	if limit < 0 {
+		return max
+	}
+	return strconv.FormatInt(limit, 10)
+}
+
+// writeLimit writes a limit to a cgroup file, max for Unlimited
+func writeLimit(file string, limit int64, max string) error {
+	value := formatLimit(limit, max)
+	if err := os.WriteFile(file, []byte(value), 0644); err != nil {
+		return errors.Wrapf(err, "unable to write %s to %s", value, filepath.Base(file))
+	}
+	return nil
+}
+
+// readKeyValue reads the value of key in a flat keyed cgroup file,
+// such as memory.events: one "key value" pair per line.
+func readKeyValue(file, key string) (int, error) {
+	values, err := readKeyValues(file)
+	if err != nil {
+		return 0, err
+	}
+	value, ok := values[key]
+	if !ok {
+		return 0, errors.Errorf("no %s in %s", key, file)
+	}
+	return int(value), nil
+}
+
+// freezeTimeout is how long Freeze and Thaw wait for the CGroups
+// to reach the requested state
+const freezeTimeout = 5 * time.Second
+
+// waitFreezerState polls the CGroups freezer state with get until it is
+// the wanted one
+func waitFreezerState(get func() (bool, error), frozen bool) error {
+	deadline := time.Now().Add(freezeTimeout)
+	for {
+		state, err := get()
+		if err != nil {
+			return err
+		}
+		if state == frozen {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return errors.Errorf("timeout waiting for cgroup to be frozen=%t", frozen)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
 }
 
-// NewCGroups returns a new CGroups instance
+// NewCGroups returns the CGroups of path, which isn't created until
+// Create is called
 func NewCGroups(path string) (CGroups, error) {
 	var cg CGroups
 	cgMode, err := Mode()
@@ -34,16 +208,59 @@ func NewCGroups(path string) (CGroups, error) {
 
 	switch cgMode {
 	case Legacy, Hybrid:
-		return newCGroupsv1(path)
+		if userns.Rootless() {
+			return cg, errors.New("rootless mode requires cgroups v2 (unified mode)")
+		}
+		return newCGroupsv1(path), nil
 	case Unified:
 		// Handle CGroup v2
-		createKokerGroup()
-		return newCGroupsv2(path)
+		root := constants.CGroupMountpoint
+		if userns.Rootless() {
+			// Unprivileged users can only manage the subtree
+			// that systemd delegates to them
+			root, err = delegatedRoot()
+			if err != nil {
+				return cg, err
+			}
+		}
+		return newCGroupsv2(root, path), nil
 	default:
 		return cg, nil
 	}
 }
 
+// userServiceRe matches the user manager unit which systemd delegates
+// to the user: user@<uid>.service
+var userServiceRe = regexp.MustCompile(`^user@[0-9]+\.service$`)
+
+// delegatedRoot returns the cgroup v2 subtree delegated to the current
+// user, found by walking up our own cgroup to user@<uid>.service.
+func delegatedRoot() (string, error) {
+	f, err := os.Open("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	var cgPath string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Unified hierarchy entry: 0::/user.slice/user-1000.slice/...
+		if line := scanner.Text(); strings.HasPrefix(line, "0::") {
+			cgPath = strings.TrimPrefix(line, "0::")
+			break
+		}
+	}
+
+	for dir := cgPath; dir != "/" && dir != "."; dir = filepath.Dir(dir) {
+		if userServiceRe.MatchString(filepath.Base(dir)) {
+			return filepath.Join(constants.CGroupMountpoint, dir), nil
+		}
+	}
+	return "", errors.Errorf("cgroup %q is not delegated to the user, "+
+		"try running koker with `systemd-run --user --scope`", cgPath)
+}
+
 // CGMode is the cgroups mode of the host system
 type CGMode int
 
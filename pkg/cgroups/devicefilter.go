@@ -0,0 +1,261 @@
+package cgroups
+
+import (
+	"os"
+	"runtime"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// bpfInsn is an eBPF instruction, struct bpf_insn
+type bpfInsn struct {
+	code uint8
+	// dst_reg:4, src_reg:4
+	regs uint8
+	off  int16
+	imm  int32
+}
+
+// bpfProgLoadAttr is the BPF_PROG_LOAD part of union bpf_attr
+type bpfProgLoadAttr struct {
+	progType    uint32
+	insnCnt     uint32
+	insns       uint64
+	license     uint64
+	logLevel    uint32
+	logSize     uint32
+	logBuf      uint64
+	kernVersion uint32
+	progFlags   uint32
+}
+
+// bpfProgAttachAttr is the BPF_PROG_ATTACH part of union bpf_attr
+type bpfProgAttachAttr struct {
+	targetFd    uint32
+	attachBpfFd uint32
+	attachType  uint32
+	attachFlags uint32
+}
+
+// bpfProgQueryAttr is the BPF_PROG_QUERY part of union bpf_attr
+type bpfProgQueryAttr struct {
+	targetFd    uint32
+	attachType  uint32
+	queryFlags  uint32
+	attachFlags uint32
+	progIDs     uint64
+	progCnt     uint32
+	_           uint32
+}
+
+// bpfProgGetFdByIDAttr is the BPF_PROG_GET_FD_BY_ID part of union bpf_attr
+type bpfProgGetFdByIDAttr struct {
+	progID    uint32
+	nextID    uint32
+	openFlags uint32
+}
+
+// maxCgroupProgs is the kernel's limit of programs attached to a cgroup
+// for an attach type, BPF_CGROUP_MAX_PROGS
+const maxCgroupProgs = 64
+
+// bpf runs the bpf syscall cmd with attr
+func bpf(cmd int, attr unsafe.Pointer, size uintptr) (int, error) {
+	fd, _, errno := unix.Syscall(unix.SYS_BPF, uintptr(cmd), uintptr(attr), size)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(fd), nil
+}
+
+// ldxw loads the 32 bits word at src+off to dst
+func ldxw(dst, src uint8, off int16) bpfInsn {
+	return bpfInsn{code: unix.BPF_LDX | unix.BPF_MEM | unix.BPF_W, regs: dst | src<<4, off: off}
+}
+
+// alu32 applies a 32 bits operation with an immediate to dst
+func alu32(op uint8, dst uint8, imm int32) bpfInsn {
+	return bpfInsn{code: unix.BPF_ALU | op | unix.BPF_K, regs: dst, imm: imm}
+}
+
+// mov32 copies the low 32 bits of src to dst
+func mov32(dst, src uint8) bpfInsn {
+	return bpfInsn{code: unix.BPF_ALU | unix.BPF_MOV | unix.BPF_X, regs: dst | src<<4}
+}
+
+// jne jumps when dst isn't imm, the offset is set once the
+// block is complete
+func jne(dst uint8, imm int32) bpfInsn {
+	return bpfInsn{code: unix.BPF_JMP | unix.BPF_JNE | unix.BPF_K, regs: dst, imm: imm}
+}
+
+// ret returns imm
+func ret(imm int32) []bpfInsn {
+	return []bpfInsn{
+		{code: unix.BPF_ALU64 | unix.BPF_MOV | unix.BPF_K, regs: 0, imm: imm},
+		{code: unix.BPF_JMP | unix.BPF_EXIT},
+	}
+}
+
+// deviceFilter returns a BPF_PROG_TYPE_CGROUP_DEVICE program which
+// denies device access, unless allowed by the rules. The last matching
+// rule wins, as when rules are written to devices.allow and devices.deny.
+func deviceFilter(rules []DeviceRule) []bpfInsn {
+	// struct bpf_cgroup_dev_ctx: access_type (access << 16 | type),
+	// major and minor, loaded to r2 (type), r3 (access), r4 and r5.
+	prog := []bpfInsn{
+		ldxw(2, 1, 0),
+		alu32(unix.BPF_AND, 2, 0xffff),
+		ldxw(3, 1, 0),
+		alu32(unix.BPF_RSH, 3, 16),
+		ldxw(4, 1, 4),
+		ldxw(5, 1, 8),
+	}
+	for i := len(rules) - 1; i >= 0; i-- {
+		prog = append(prog, deviceRuleBlock(rules[i])...)
+	}
+	return append(prog, ret(0)...)
+}
+
+// deviceRuleBlock returns the instructions returning the verdict of
+// a rule if it matches, or jumping to the next block.
+func deviceRuleBlock(rule DeviceRule) []bpfInsn {
+	var block []bpfInsn
+	switch rule.Type {
+	case 'c':
+		block = append(block, jne(2, unix.BPF_DEVCG_DEV_CHAR))
+	case 'b':
+		block = append(block, jne(2, unix.BPF_DEVCG_DEV_BLOCK))
+	}
+
+	var access int32
+	for _, a := range rule.Access {
+		switch a {
+		case 'r':
+			access |= unix.BPF_DEVCG_ACC_READ
+		case 'w':
+			access |= unix.BPF_DEVCG_ACC_WRITE
+		case 'm':
+			access |= unix.BPF_DEVCG_ACC_MKNOD
+		}
+	}
+	if all := int32(unix.BPF_DEVCG_ACC_READ | unix.BPF_DEVCG_ACC_WRITE | unix.BPF_DEVCG_ACC_MKNOD); access != all {
+		// Every requested access must be in the rule
+		block = append(block, mov32(1, 3), alu32(unix.BPF_AND, 1, ^access), jne(1, 0))
+	}
+	if rule.Major >= 0 {
+		block = append(block, jne(4, int32(rule.Major)))
+	}
+	if rule.Minor >= 0 {
+		block = append(block, jne(5, int32(rule.Minor)))
+	}
+
+	verdict := int32(0)
+	if rule.Allow {
+		verdict = 1
+	}
+	block = append(block, ret(verdict)...)
+
+	// Mismatches jump to the end of the block
+	for i := range block {
+		if block[i].code == unix.BPF_JMP|unix.BPF_JNE|unix.BPF_K {
+			block[i].off = int16(len(block) - i - 1)
+		}
+	}
+	return block
+}
+
+// attachDeviceFilter loads the device filter of the rules and
+// attaches it to a cgroup v2 directory, in place of the filters
+// previously attached by a former start of the container.
+func attachDeviceFilter(dir string, rules []DeviceRule) error {
+	insns := deviceFilter(rules)
+	license := []byte("Apache-2.0\x00")
+	loadAttr := bpfProgLoadAttr{
+		progType: unix.BPF_PROG_TYPE_CGROUP_DEVICE,
+		insnCnt:  uint32(len(insns)),
+		insns:    uint64(uintptr(unsafe.Pointer(&insns[0]))),
+		license:  uint64(uintptr(unsafe.Pointer(&license[0]))),
+	}
+	progFd, err := bpf(unix.BPF_PROG_LOAD, unsafe.Pointer(&loadAttr), unsafe.Sizeof(loadAttr))
+	runtime.KeepAlive(insns)
+	runtime.KeepAlive(license)
+	if err != nil {
+		return errors.Wrap(err, "unable to load device filter")
+	}
+	// The attached program is kept by the cgroup
+	defer unix.Close(progFd)
+
+	cgroup, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer cgroup.Close()
+	cgroupFd := int(cgroup.Fd())
+
+	previous, err := attachedPrograms(cgroupFd)
+	if err != nil {
+		return err
+	}
+
+	// Nested cgroups may attach their own filter, every one must allow
+	// the access. The previous filters are detached once the new one is
+	// attached, so the devices are never left unfiltered.
+	attachAttr := bpfProgAttachAttr{
+		targetFd:    uint32(cgroupFd),
+		attachBpfFd: uint32(progFd),
+		attachType:  unix.BPF_CGROUP_DEVICE,
+		attachFlags: unix.BPF_F_ALLOW_MULTI,
+	}
+	if _, err := bpf(unix.BPF_PROG_ATTACH, unsafe.Pointer(&attachAttr), unsafe.Sizeof(attachAttr)); err != nil {
+		return errors.Wrap(err, "unable to attach device filter")
+	}
+	for _, id := range previous {
+		if err := detachProgram(cgroupFd, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// attachedPrograms returns the ids of the device filters attached to
+// a cgroup, not the ones inherited from its parents
+func attachedPrograms(cgroupFd int) ([]uint32, error) {
+	ids := make([]uint32, maxCgroupProgs)
+	queryAttr := bpfProgQueryAttr{
+		targetFd:   uint32(cgroupFd),
+		attachType: unix.BPF_CGROUP_DEVICE,
+		progIDs:    uint64(uintptr(unsafe.Pointer(&ids[0]))),
+		progCnt:    uint32(len(ids)),
+	}
+	_, err := bpf(unix.BPF_PROG_QUERY, unsafe.Pointer(&queryAttr), unsafe.Sizeof(queryAttr))
+	runtime.KeepAlive(ids)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to query device filters")
+	}
+	return ids[:queryAttr.progCnt], nil
+}
+
+// detachProgram detaches the device filter id from a cgroup
+func detachProgram(cgroupFd int, id uint32) error {
+	getAttr := bpfProgGetFdByIDAttr{progID: id}
+	progFd, err := bpf(unix.BPF_PROG_GET_FD_BY_ID, unsafe.Pointer(&getAttr), unsafe.Sizeof(getAttr))
+	if err == unix.ENOENT {
+		return nil
+	} else if err != nil {
+		return errors.Wrapf(err, "unable to get device filter %d", id)
+	}
+	defer unix.Close(progFd)
+
+	detachAttr := bpfProgAttachAttr{
+		targetFd:    uint32(cgroupFd),
+		attachBpfFd: uint32(progFd),
+		attachType:  unix.BPF_CGROUP_DEVICE,
+	}
+	if _, err := bpf(unix.BPF_PROG_DETACH, unsafe.Pointer(&detachAttr), unsafe.Sizeof(detachAttr)); err != nil && err != unix.ENOENT {
+		return errors.Wrapf(err, "unable to detach device filter %d", id)
+	}
+	return nil
+}
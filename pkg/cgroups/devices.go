@@ -0,0 +1,63 @@
+package cgroups
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// DeviceRule allows or denies access to devices, as written
+// to devices.allow and devices.deny of cgroups v1
+type DeviceRule struct {
+	// Type is a (all devices), c (char) or b (block)
+	Type byte
+	// Major and Minor numbers, -1 for any
+	Major int64
+	Minor int64
+	// Access is a combination of r (read), w (write) and m (mknod)
+	Access string
+	Allow  bool
+}
+
+// AllowAllDevices is the rule of privileged containers
+var AllowAllDevices = DeviceRule{Type: 'a', Major: -1, Minor: -1, Access: "rwm", Allow: true}
+
+// deviceRuleRe matches device rules: type major:minor access
+var deviceRuleRe = regexp.MustCompile(`^([abc]) ([0-9]+|\*):([0-9]+|\*) ([rwm]{1,3})$`)
+
+// ParseDeviceRule parses an allow rule in devices.allow format,
+// e.g. 'c 10:200 rwm' or 'b 8:* r'
+func ParseDeviceRule(s string) (DeviceRule, error) {
+	rule := DeviceRule{Allow: true}
+	m := deviceRuleRe.FindStringSubmatch(s)
+	if m == nil {
+		return rule, errors.Errorf("invalid device cgroup rule %q, expected 'type major:minor access'", s)
+	}
+	rule.Type = m[1][0]
+	for i, n := range []*int64{&rule.Major, &rule.Minor} {
+		if m[i+2] == "*" {
+			*n = -1
+			continue
+		}
+		v, err := strconv.ParseInt(m[i+2], 10, 64)
+		if err != nil {
+			return rule, errors.Errorf("invalid device cgroup rule %q", s)
+		}
+		*n = v
+	}
+	rule.Access = m[4]
+	return rule, nil
+}
+
+// String returns the rule in devices.allow format
+func (r DeviceRule) String() string {
+	number := func(n int64) string {
+		if n < 0 {
+			return "*"
+		}
+		return strconv.FormatInt(n, 10)
+	}
+	return fmt.Sprintf("%c %s:%s %s", r.Type, number(r.Major), number(r.Minor), r.Access)
+}
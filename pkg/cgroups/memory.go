@@ -0,0 +1,15 @@
+package cgroups
+
+// MemorySettings are the effective memory settings of a CGroups, in
+// bytes, 0 being no limit. The settings the cgroups version lacks are
+// nil.
+type MemorySettings struct {
+	Limit       uint64 `json:"limit"`
+	Reservation uint64 `json:"reservation"`
+	// High is the throttling limit of cgroups v2
+	High *uint64 `json:"high,omitempty"`
+	// Swappiness of cgroups v1, the kernel's tendency to swap the
+	// CGroups memory, from 0 to 100
+	Swappiness     *uint64 `json:"swappiness,omitempty"`
+	OOMKillDisable bool    `json:"oom_kill_disable"`
+}
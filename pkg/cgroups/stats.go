@@ -0,0 +1,106 @@
+package cgroups
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Stats are the resource usage statistics of a CGroups
+type Stats struct {
+	CPU    CPUStats    `json:"cpu"`
+	Memory MemoryStats `json:"memory"`
+	Pids   PidsStats   `json:"pids"`
+	IO     IOStats     `json:"io"`
+}
+
+// CPUStats are the CPU times used by the CGroups processes, in nanoseconds
+type CPUStats struct {
+	Usage  uint64 `json:"usage"`
+	User   uint64 `json:"user"`
+	System uint64 `json:"system"`
+}
+
+// MemoryStats are in bytes, Limit is 0 without memory limit
+type MemoryStats struct {
+	Usage uint64 `json:"usage"`
+	Limit uint64 `json:"limit"`
+	// Cache is the page cache part of Usage
+	Cache uint64 `json:"cache"`
+	// Peak is the maximum usage recorded, 0 if the kernel doesn't
+	Peak uint64 `json:"peak"`
+}
+
+// PidsStats are the number of processes, Limit is 0 without pids limit
+type PidsStats struct {
+	Current uint64 `json:"current"`
+	Limit   uint64 `json:"limit"`
+	// Peak is the maximum number of processes, 0 if the kernel doesn't
+	Peak uint64 `json:"peak"`
+}
+
+// IOStats are the bytes read from and written to block devices
+type IOStats struct {
+	ReadBytes  uint64 `json:"read_bytes"`
+	WriteBytes uint64 `json:"write_bytes"`
+}
+
+// unlimited is the lowest value a cgroup v1 file reports as no limit,
+// the maximum page aligned int64
+const unlimited = 1 << 62
+
+// readUint reads a cgroup file with a single value. "max", the cgroups
+// v2 value of no limit, is read as 0.
+func readUint(file string) (uint64, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return 0, err
+	}
+	value := strings.TrimSpace(string(b))
+	if value == "max" {
+		return 0, nil
+	}
+	return strconv.ParseUint(value, 10, 64)
+}
+
+// readLimit reads a cgroup file with a limit, 0 if there is none
+func readLimit(file string) (uint64, error) {
+	limit, err := readUint(file)
+	if limit >= unlimited {
+		limit = 0
+	}
+	return limit, err
+}
+
+// readKeyValues reads the values of a flat keyed cgroup file, such as
+// cpu.stat or memory.stat: one "key value" pair per line.
+func readKeyValues(file string) (map[string]uint64, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := make(map[string]uint64)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), " ")
+		if !ok {
+			continue
+		}
+		if v, err := strconv.ParseUint(value, 10, 64); err == nil {
+			values[key] = v
+		}
+	}
+	return values, scanner.Err()
+}
+
+// ignoreNotExist ignores the error of a missing cgroup file: the
+// controller isn't available, its statistics stay zero.
+func ignoreNotExist(err error) error {
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
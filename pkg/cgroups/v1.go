@@ -4,10 +4,16 @@ import (
 	"bufio"
 	"os"
 	"path/filepath"
-	"runtime"
+	"sort"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
 
 	"github.com/ntk148v/koker/pkg/constants"
+	"github.com/ntk148v/koker/pkg/filesystem"
 	"github.com/ntk148v/koker/pkg/utils"
 )
 
@@ -15,65 +21,270 @@ type cgroupsv1 struct {
 	dirs map[string]string
 }
 
-func newCGroupsv1(path string) (cgroupsv1, error) {
-	cg := cgroupsv1{}
-	// create dirs
-	cg.dirs = map[string]string{
-		"memory": filepath.Join(constants.CGroupMountpoint, "memory", path),
-		"cpu":    filepath.Join(constants.CGroupMountpoint, "cpu", path),
-		"pids":   filepath.Join(constants.CGroupMountpoint, "pids", path),
+func newCGroupsv1(path string) cgroupsv1 {
+	return cgroupsv1{
+		dirs: map[string]string{
+			"memory":  filepath.Join(constants.CGroupMountpoint, "memory", path),
+			"cpu":     filepath.Join(constants.CGroupMountpoint, "cpu", path),
+			"cpuacct": filepath.Join(constants.CGroupMountpoint, "cpuacct", path),
+			"blkio":   filepath.Join(constants.CGroupMountpoint, "blkio", path),
+			"pids":    filepath.Join(constants.CGroupMountpoint, "pids", path),
+			"devices": filepath.Join(constants.CGroupMountpoint, "devices", path),
+			"freezer": filepath.Join(constants.CGroupMountpoint, "freezer", path),
+			"cpuset":  filepath.Join(constants.CGroupMountpoint, "cpuset", path),
+		},
 	}
+}
 
+// Create creates the CGroups directories of every controller
+func (cg cgroupsv1) Create() error {
 	for _, dir := range cg.dirs {
 		if err := utils.CreateDir(dir); err != nil {
-			return cg, err
+			return err
 		}
 	}
-	return cg, nil
+	return initCpuset(cg.dirs["cpuset"])
 }
 
-// SetMemSwpLimit sets memory and swap limit for CGroups
-func (cg cgroupsv1) SetMemSwpLimit(memory, swap int) error {
-	if memory > 0 {
-		memFile := filepath.Join(cg.dirs["memory"], "memory.limit_in_bytes")
-		if err := os.WriteFile(memFile, []byte(strconv.Itoa(memory*1024*1024)), 0644); err != nil {
+// initCpuset gives the new cpuset cgroup dir, and its parents up to the
+// root, the CPUs and memory nodes of their parent. A cpuset cgroup
+// starts with none, no process can be added to it.
+func initCpuset(dir string) error {
+	root := filepath.Join(constants.CGroupMountpoint, "cpuset")
+	if dir == root {
+		return nil
+	}
+	if err := initCpuset(filepath.Dir(dir)); err != nil {
+		return err
+	}
+	for _, file := range []string{"cpuset.cpus", "cpuset.mems"} {
+		current, err := os.ReadFile(filepath.Join(dir, file))
+		if err != nil {
 			return err
 		}
-		if swap > 0 {
-			memswFile := filepath.Join(cg.dirs["memory"], "memory.memsw.limit_in_bytes")
-			if err := os.WriteFile(memswFile, []byte(strconv.Itoa((memory+swap)*1024*1024)), 0644); err != nil {
-				return err
-			}
+		if len(strings.TrimSpace(string(current))) > 0 {
+			continue
+		}
+		parent, err := os.ReadFile(filepath.Join(filepath.Dir(dir), file))
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(dir, file), parent, 0644); err != nil {
+			return errors.Wrapf(err, "unable to initialize %s", file)
 		}
 	}
 	return nil
 }
 
+// SetMemSwpLimit sets memory and swap limit for CGroups. cgroups v1
+// limit memory+swap, swap can't be limited without swap accounting.
+func (cg cgroupsv1) SetMemSwpLimit(memory, swap int64) error {
+	if memory == 0 {
+		return nil
+	}
+	memFile := filepath.Join(cg.dirs["memory"], "memory.limit_in_bytes")
+	memswFile := filepath.Join(cg.dirs["memory"], "memory.memsw.limit_in_bytes")
+	if _, err := os.Stat(memswFile); os.IsNotExist(err) {
+		return writeLimit(memFile, memory, "-1")
+	}
+
+	memsw := int64(Unlimited)
+	if memory > 0 && swap >= 0 {
+		memsw = memory + swap
+	}
+	// The memory limit can't exceed the memory+swap one, which is
+	// raised first and lowered last
+	current, err := readLimit(memswFile)
+	if err != nil {
+		return err
+	}
+	if memsw == Unlimited || (current > 0 && uint64(memsw) > current) {
+		if err := writeLimit(memswFile, memsw, "-1"); err != nil {
+			return err
+		}
+		return writeLimit(memFile, memory, "-1")
+	}
+	if err := writeLimit(memFile, memory, "-1"); err != nil {
+		return err
+	}
+	return writeLimit(memswFile, memsw, "-1")
+}
+
+// SetMemoryReservation writes the soft limit to memory.soft_limit_in_bytes
+func (cg cgroupsv1) SetMemoryReservation(reservation int64) error {
+	if reservation == 0 {
+		return nil
+	}
+	return writeLimit(filepath.Join(cg.dirs["memory"], "memory.soft_limit_in_bytes"), reservation, "-1")
+}
+
+// SetMemoryHigh fails, cgroups v1 have no memory throttling
+func (cg cgroupsv1) SetMemoryHigh(high int64) error {
+	if high == 0 {
+		return nil
+	}
+	return errors.New("memory high limit requires cgroups v2, the host uses cgroups v1")
+}
+
+// SetMemorySwappiness writes the swappiness to memory.swappiness
+func (cg cgroupsv1) SetMemorySwappiness(swappiness int) error {
+	if swappiness < 0 {
+		return nil
+	}
+	return writeLimit(filepath.Join(cg.dirs["memory"], "memory.swappiness"), int64(swappiness), "")
+}
+
+// SetOOMKillDisable writes 1 to memory.oom_control
+func (cg cgroupsv1) SetOOMKillDisable(disable bool) error {
+	if !disable {
+		return nil
+	}
+	return writeLimit(filepath.Join(cg.dirs["memory"], "memory.oom_control"), 1, "")
+}
+
+// MemorySettings reads the memory limits, swappiness and OOM control
+func (cg cgroupsv1) MemorySettings() (*MemorySettings, error) {
+	memory := cg.dirs["memory"]
+	settings := &MemorySettings{}
+	var err error
+	if settings.Limit, err = readLimit(filepath.Join(memory, "memory.limit_in_bytes")); err != nil {
+		return nil, err
+	}
+	if settings.Reservation, err = readLimit(filepath.Join(memory, "memory.soft_limit_in_bytes")); err != nil {
+		return nil, err
+	}
+	swappiness, err := readUint(filepath.Join(memory, "memory.swappiness"))
+	if err != nil {
+		return nil, err
+	}
+	settings.Swappiness = &swappiness
+	oomKillDisable, err := readKeyValue(filepath.Join(memory, "memory.oom_control"), "oom_kill_disable")
+	if err != nil {
+		return nil, err
+	}
+	settings.OOMKillDisable = oomKillDisable == 1
+	return settings, nil
+}
+
 // SetPidsLimit sets maximum processes than can be created
 // simultaneously in CGroups
 func (cg cgroupsv1) SetPidsLimit(pids int) error {
-	if pids > 0 {
-		pidsFile := filepath.Join(cg.dirs["pids"], "pids.max")
-		if err := os.WriteFile(pidsFile, []byte(strconv.Itoa(pids)), 0644); err != nil {
+	if pids == 0 {
+		return nil
+	}
+	return writeLimit(filepath.Join(cg.dirs["pids"], "pids.max"), int64(pids), "max")
+}
+
+// SetCPULimit sets number of CPU for the CGroups, as a CFS quota of
+// cpus periods
+func (cg cgroupsv1) SetCPULimit(cpus float64) error {
+	if cpus == 0 {
+		return nil
+	}
+	cpuPeriodFile := filepath.Join(cg.dirs["cpu"], "cpu.cfs_period_us")
+	if err := os.WriteFile(cpuPeriodFile, []byte(strconv.Itoa(constants.DefaultCfsPeriod)),
+		0644); err != nil {
+		return err
+	}
+	cpuQuotaFile := filepath.Join(cg.dirs["cpu"], "cpu.cfs_quota_us")
+	return writeLimit(cpuQuotaFile, cpuQuota(cpus), "-1")
+}
+
+// SetCPUQuota writes the CFS period and quota to cpu.cfs_period_us and
+// cpu.cfs_quota_us
+func (cg cgroupsv1) SetCPUQuota(quota, period int64) error {
+	if period > 0 {
+		periodFile := filepath.Join(cg.dirs["cpu"], "cpu.cfs_period_us")
+		if err := writeLimit(periodFile, period, ""); err != nil {
 			return err
 		}
 	}
+	if quota == 0 {
+		return nil
+	}
+	return writeLimit(filepath.Join(cg.dirs["cpu"], "cpu.cfs_quota_us"), quota, "-1")
+}
+
+// SetCPUShares writes the shares to cpu.shares
+func (cg cgroupsv1) SetCPUShares(shares uint64) error {
+	if shares == 0 {
+		return nil
+	}
+	return writeLimit(filepath.Join(cg.dirs["cpu"], "cpu.shares"), int64(shares), "")
+}
+
+// SetCPUWeight writes the weight, converted to shares, to cpu.shares
+func (cg cgroupsv1) SetCPUWeight(weight uint64) error {
+	return cg.SetCPUShares(WeightToShares(weight))
+}
+
+// SetCpusetCPUs writes the CPUs list to cpuset.cpus
+func (cg cgroupsv1) SetCpusetCPUs(cpus string) error {
+	return cg.setCpuset("cpuset.cpus", cpus)
+}
+
+// SetCpusetMems writes the memory nodes list to cpuset.mems
+func (cg cgroupsv1) SetCpusetMems(mems string) error {
+	return cg.setCpuset("cpuset.mems", mems)
+}
+
+func (cg cgroupsv1) setCpuset(file, list string) error {
+	if list == "" {
+		return nil
+	}
+	if err := os.WriteFile(filepath.Join(cg.dirs["cpuset"], file), []byte(list), 0644); err != nil {
+		return errors.Wrapf(err, "unable to set %s to %s", file, list)
+	}
 	return nil
 }
 
-// SetCPULimit sets number of CPU for the CGroups
-func (cg cgroupsv1) SetCPULimit(cpus float64) error {
-	if int(cpus) > 0 && int(cpus) < runtime.NumCPU() {
-		cpuPeriodFile := filepath.Join(cg.dirs["cpu"], "cpu.cfs_period_us")
-		if err := os.WriteFile(cpuPeriodFile, []byte(strconv.Itoa(constants.DefaultCfsPeriod)),
-			0644); err != nil {
-			return err
+// SetBlkioWeight writes the weight to blkio.weight, or blkio.bfq.weight
+// with the BFQ scheduler
+func (cg cgroupsv1) SetBlkioWeight(weight uint16) error {
+	if weight == 0 {
+		return nil
+	}
+	file := "blkio.weight"
+	if fileExists(cg.dirs["blkio"], "blkio.bfq.weight") {
+		file = "blkio.bfq.weight"
+	}
+	return writeWeight(cg.dirs["blkio"], file, uint64(weight))
+}
+
+// SetBlkioThrottle writes the rate limits to the blkio.throttle files,
+// one device at a time
+func (cg cgroupsv1) SetBlkioThrottle(throttle BlkioThrottle) error {
+	files := map[string][]ThrottleDevice{
+		"blkio.throttle.read_bps_device":   throttle.ReadBps,
+		"blkio.throttle.write_bps_device":  throttle.WriteBps,
+		"blkio.throttle.read_iops_device":  throttle.ReadIOPS,
+		"blkio.throttle.write_iops_device": throttle.WriteIOPS,
+	}
+	for file, devices := range files {
+		for _, d := range devices {
+			path := filepath.Join(cg.dirs["blkio"], file)
+			if err := os.WriteFile(path, []byte(d.String()), 0644); err != nil {
+				return errors.Wrapf(err, "unable to write %s to %s", d, file)
+			}
 		}
+	}
+	return nil
+}
 
-		cpuQuotaFile := filepath.Join(cg.dirs["cpu"], "cpu.cfs_quota_us")
-		if err := os.WriteFile(cpuQuotaFile, []byte(strconv.Itoa(int(cpus*constants.DefaultCfsPeriod))),
-			0644); err != nil {
-			return err
+// SetDeviceRules denies access to all devices, then writes
+// the rules to devices.allow or devices.deny
+func (cg cgroupsv1) SetDeviceRules(rules []DeviceRule) error {
+	denyFile := filepath.Join(cg.dirs["devices"], "devices.deny")
+	if err := os.WriteFile(denyFile, []byte("a"), 0644); err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		file := denyFile
+		if rule.Allow {
+			file = filepath.Join(cg.dirs["devices"], "devices.allow")
+		}
+		if err := os.WriteFile(file, []byte(rule.String()), 0644); err != nil {
+			return errors.Wrapf(err, "unable to set device rule %q", rule)
 		}
 	}
 	return nil
@@ -121,3 +332,223 @@ func (cg cgroupsv1) GetPids() ([]string, error) {
 
 	return pids, nil
 }
+
+// Mount mounts a tmpfs at target with the memory, cpu and pids
+// hierarchies in it. Co-mounted controllers, such as cpu,cpuacct,
+// get a symlink for each controller.
+func (cg cgroupsv1) Mount(target string, readOnly bool) (filesystem.Unmounter, error) {
+	flag := uintptr(syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC)
+	mountOpts := []filesystem.MountOption{
+		{Source: "tmpfs", Target: target, Type: "tmpfs", Flag: flag, Option: "mode=755"},
+	}
+	hierarchyFlag := flag
+	if readOnly {
+		hierarchyFlag |= syscall.MS_RDONLY
+	}
+
+	controllers := make([]string, 0, len(cg.dirs))
+	for controller := range cg.dirs {
+		controllers = append(controllers, controller)
+	}
+	sort.Strings(controllers)
+
+	// Symlinks of co-mounted controllers to their hierarchy
+	links := make(map[string]string)
+	mounted := make(map[string]bool)
+	for _, controller := range controllers {
+		hierarchy, err := hierarchyOf(controller)
+		if err != nil {
+			return nil, err
+		}
+		if hierarchy != controller {
+			links[controller] = hierarchy
+		}
+		if mounted[hierarchy] {
+			continue
+		}
+		mounted[hierarchy] = true
+		mountOpts = append(mountOpts, filesystem.MountOption{
+			Source: "cgroup",
+			Target: filepath.Join(target, hierarchy),
+			Type:   "cgroup",
+			Flag:   hierarchyFlag,
+			Option: hierarchy,
+		})
+	}
+
+	unmount, err := filesystem.Mount(mountOpts...)
+	if err != nil {
+		return unmount, err
+	}
+	for controller, hierarchy := range links {
+		if err := os.Symlink(hierarchy, filepath.Join(target, controller)); err != nil {
+			return unmount, err
+		}
+	}
+	if !readOnly {
+		return unmount, nil
+	}
+
+	// The tmpfs is made read-only once the hierarchies are mounted
+	if err := syscall.Mount("", target, "", flag|syscall.MS_REMOUNT|syscall.MS_RDONLY, "mode=755"); err != nil {
+		return unmount, errors.Wrapf(err, "unable to remount %s read-only", target)
+	}
+	return unmount, nil
+}
+
+// hierarchyOf returns the hierarchy of a controller, its comma separated
+// co-mounted controllers, as listed in /proc/self/cgroup.
+func hierarchyOf(controller string) (string, error) {
+	f, err := os.Open("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Hierarchy entry: 4:cpu,cpuacct:/koker/<id>
+		fields := strings.SplitN(scanner.Text(), ":", 3)
+		if len(fields) < 3 {
+			continue
+		}
+		for _, c := range strings.Split(fields[1], ",") {
+			if c == controller {
+				return fields[1], nil
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", errors.Errorf("no cgroup hierarchy found for %s controller", controller)
+}
+
+// Delegate isn't supported on cgroups v1, the hierarchies can only be
+// mounted read-write.
+func (cg cgroupsv1) Delegate() error {
+	return errors.New("cgroup delegation requires cgroups v2")
+}
+
+// Freeze writes FROZEN to freezer.state, the CGroups stays FREEZING
+// until all its processes are frozen
+func (cg cgroupsv1) Freeze() error {
+	return cg.setFreezerState("FROZEN", true)
+}
+
+// Thaw writes THAWED to freezer.state
+func (cg cgroupsv1) Thaw() error {
+	return cg.setFreezerState("THAWED", false)
+}
+
+// setFreezerState writes state to freezer.state and waits for it
+func (cg cgroupsv1) setFreezerState(state string, frozen bool) error {
+	stateFile := filepath.Join(cg.dirs["freezer"], "freezer.state")
+	if err := os.WriteFile(stateFile, []byte(state), 0644); err != nil {
+		return errors.Wrapf(err, "unable to set freezer state to %s", state)
+	}
+	return waitFreezerState(cg.Frozen, frozen)
+}
+
+// Frozen reports whether freezer.state is FROZEN
+func (cg cgroupsv1) Frozen() (bool, error) {
+	state, err := os.ReadFile(filepath.Join(cg.dirs["freezer"], "freezer.state"))
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(string(state)) == "FROZEN", nil
+}
+
+// OOMKillCount returns the oom_kill counter of memory.oom_control
+func (cg cgroupsv1) OOMKillCount() (int, error) {
+	return readKeyValue(filepath.Join(cg.dirs["memory"], "memory.oom_control"), "oom_kill")
+}
+
+// Paths returns the CGroups directory of each controller
+func (cg cgroupsv1) Paths() map[string]string {
+	paths := make(map[string]string, len(cg.dirs))
+	for controller, dir := range cg.dirs {
+		paths[controller] = dir
+	}
+	return paths
+}
+
+// Stats reads cpuacct.usage and cpuacct.stat, memory.usage_in_bytes,
+// memory.limit_in_bytes, memory.stat and memory.max_usage_in_bytes,
+// pids.current, pids.max and pids.peak, and
+// blkio.throttle.io_service_bytes.
+func (cg cgroupsv1) Stats() (*Stats, error) {
+	var (
+		stats Stats
+		err   error
+	)
+	cpuacct, memory, pids := cg.dirs["cpuacct"], cg.dirs["memory"], cg.dirs["pids"]
+	if stats.CPU.Usage, err = readUint(filepath.Join(cpuacct, "cpuacct.usage")); err != nil {
+		return nil, err
+	}
+	cpuStat, err := readKeyValues(filepath.Join(cpuacct, "cpuacct.stat"))
+	if err != nil {
+		return nil, err
+	}
+	// In USER_HZ, 100 on all the architectures Linux supports
+	stats.CPU.User = cpuStat["user"] * uint64(time.Second) / 100
+	stats.CPU.System = cpuStat["system"] * uint64(time.Second) / 100
+
+	if stats.Memory.Usage, err = readUint(filepath.Join(memory, "memory.usage_in_bytes")); err != nil {
+		return nil, err
+	}
+	if stats.Memory.Limit, err = readLimit(filepath.Join(memory, "memory.limit_in_bytes")); err != nil {
+		return nil, err
+	}
+	memStat, err := readKeyValues(filepath.Join(memory, "memory.stat"))
+	if err != nil {
+		return nil, err
+	}
+	stats.Memory.Cache = memStat["total_cache"]
+	if stats.Memory.Peak, err = readUint(filepath.Join(memory, "memory.max_usage_in_bytes")); err != nil {
+		return nil, err
+	}
+
+	if stats.Pids.Current, err = readUint(filepath.Join(pids, "pids.current")); err != nil {
+		return nil, err
+	}
+	if stats.Pids.Limit, err = readUint(filepath.Join(pids, "pids.max")); err != nil {
+		return nil, err
+	}
+	if stats.Pids.Peak, err = readUint(filepath.Join(pids, "pids.peak")); ignoreNotExist(err) != nil {
+		return nil, err
+	}
+
+	stats.IO, err = readBlkioStats(filepath.Join(cg.dirs["blkio"], "blkio.throttle.io_service_bytes"))
+	return &stats, ignoreNotExist(err)
+}
+
+// readBlkioStats sums the Read and Write bytes of the devices in a blkio
+// file: "major:minor operation value" lines.
+func readBlkioStats(file string) (IOStats, error) {
+	var stats IOStats
+	f, err := os.Open(file)
+	if err != nil {
+		return stats, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 {
+			continue
+		}
+		value, err := strconv.ParseUint(fields[2], 10, 64)
+		if err != nil {
+			continue
+		}
+		switch fields[1] {
+		case "Read":
+			stats.ReadBytes += value
+		case "Write":
+			stats.WriteBytes += value
+		}
+	}
+	return stats, scanner.Err()
+}
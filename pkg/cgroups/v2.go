@@ -3,82 +3,293 @@ package cgroups
 import (
 	"bufio"
 	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
-	"runtime"
+	"slices"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
 
 	"github.com/ntk148v/koker/pkg/constants"
+	"github.com/ntk148v/koker/pkg/filesystem"
 	"github.com/ntk148v/koker/pkg/utils"
 )
 
-// createKokerGroup creates a child group of Root
-// then enable cpu, memory, and pids controllers
-func createKokerGroup() error {
-	kokerCGroup := filepath.Join(constants.CGroupMountpoint, constants.KokerApp)
+// kokerControllers are the controllers enabled for the containers
+var kokerControllers = []string{"cpu", "cpuset", "memory", "pids", "io"}
+
+// createKokerGroup creates a child group of root
+// then enable cpu, cpuset, memory, pids and io controllers
+func createKokerGroup(root string) error {
+	// systemd only enables cpuset in root when a unit uses it. A
+	// delegated root with processes can't enable more, the
+	// controllers it has are kept.
+	enableControllers(root)
+	kokerCGroup := filepath.Join(root, constants.KokerApp)
 	if err := utils.CreateDir(kokerCGroup); err != nil {
 		return err
 	}
+	return enableControllers(kokerCGroup)
+}
 
-	// Enable controllers
-	return os.WriteFile(filepath.Join(kokerCGroup, "cgroup.subtree_control"),
-		[]byte("+cpu +memory +pids"), 0644)
+// enableControllers enables the koker controllers available in dir for
+// its children. Enabling an unavailable controller fails the whole write.
+func enableControllers(dir string) error {
+	available, err := os.ReadFile(filepath.Join(dir, "cgroup.controllers"))
+	if err != nil {
+		return err
+	}
+	var enable []string
+	for _, controller := range strings.Fields(string(available)) {
+		if slices.Contains(kokerControllers, controller) {
+			enable = append(enable, "+"+controller)
+		}
+	}
+	return os.WriteFile(filepath.Join(dir, "cgroup.subtree_control"),
+		[]byte(strings.Join(enable, " ")), 0644)
 }
 
 type cgroupsv2 struct {
-	dir string
+	// root is the hierarchy root, or the subtree delegated to the user
+	root string
+	dir  string
 }
 
-func newCGroupsv2(path string) (cgroupsv2, error) {
-	cg := cgroupsv2{
-		dir: filepath.Join(constants.CGroupMountpoint, path),
+func newCGroupsv2(root, path string) cgroupsv2 {
+	return cgroupsv2{
+		root: root,
+		dir:  filepath.Join(root, path),
 	}
+}
 
-	return cg, utils.CreateDir(cg.dir)
+// Create creates the CGroups directory, in the koker group whose
+// controllers are enabled first
+func (cg cgroupsv2) Create() error {
+	if err := createKokerGroup(cg.root); err != nil {
+		return errors.Wrap(err, "unable to create koker cgroup")
+	}
+	return utils.CreateDir(cg.dir)
 }
 
-// SetMemSwpLimit sets memory and swap limit for CGroups
-func (cg cgroupsv2) SetMemSwpLimit(memory, swap int) error {
-	if memory > 0 {
-		memFile := filepath.Join(cg.dir, "memory.max")
-		if err := os.WriteFile(memFile, []byte(strconv.Itoa(memory*1024*1024)), 0644); err != nil {
-			return err
-		}
-		if swap > 0 {
-			memswFile := filepath.Join(cg.dir, "memory.swap.max")
-			if err := os.WriteFile(memswFile, []byte(strconv.Itoa((memory+swap)*1024*1024)), 0644); err != nil {
-				return err
-			}
-		}
+// SetMemSwpLimit sets memory and swap limit for CGroups. cgroups v2
+// limit swap alone, if the kernel accounts for it.
+func (cg cgroupsv2) SetMemSwpLimit(memory, swap int64) error {
+	if memory == 0 {
+		return nil
 	}
-	return nil
+	if err := writeLimit(filepath.Join(cg.dir, "memory.max"), memory, "max"); err != nil {
+		return err
+	}
+	swapFile := filepath.Join(cg.dir, "memory.swap.max")
+	if _, err := os.Stat(swapFile); os.IsNotExist(err) {
+		return nil
+	}
+	if memory < 0 {
+		swap = Unlimited
+	}
+	return writeLimit(swapFile, swap, "max")
+}
+
+// SetMemoryReservation writes the soft limit to memory.low, the memory
+// protected from reclaim
+func (cg cgroupsv2) SetMemoryReservation(reservation int64) error {
+	if reservation == 0 {
+		return nil
+	}
+	return writeLimit(filepath.Join(cg.dir, "memory.low"), reservation, "max")
+}
+
+// SetMemoryHigh writes the throttling limit to memory.high
+func (cg cgroupsv2) SetMemoryHigh(high int64) error {
+	if high == 0 {
+		return nil
+	}
+	return writeLimit(filepath.Join(cg.dir, "memory.high"), high, "max")
+}
+
+// SetMemorySwappiness fails, cgroups v2 have no swappiness
+func (cg cgroupsv2) SetMemorySwappiness(swappiness int) error {
+	if swappiness < 0 {
+		return nil
+	}
+	return errors.New("memory swappiness requires cgroups v1, the host uses cgroups v2")
+}
+
+// SetOOMKillDisable fails, the OOM killer can't be disabled on
+// cgroups v2
+func (cg cgroupsv2) SetOOMKillDisable(disable bool) error {
+	if !disable {
+		return nil
+	}
+	return errors.New("disabling the OOM killer requires cgroups v1, the host uses cgroups v2")
+}
+
+// MemorySettings reads memory.max, memory.low and memory.high
+func (cg cgroupsv2) MemorySettings() (*MemorySettings, error) {
+	settings := &MemorySettings{}
+	var err error
+	if settings.Limit, err = readUint(filepath.Join(cg.dir, "memory.max")); err != nil {
+		return nil, err
+	}
+	if settings.Reservation, err = readUint(filepath.Join(cg.dir, "memory.low")); err != nil {
+		return nil, err
+	}
+	high, err := readUint(filepath.Join(cg.dir, "memory.high"))
+	if err != nil {
+		return nil, err
+	}
+	settings.High = &high
+	return settings, nil
 }
 
 // SetPidsLimit sets maximum processes than can be created
 // simultaneously in CGroups
 func (cg cgroupsv2) SetPidsLimit(pids int) error {
-	if pids > 0 {
-		pidsFile := filepath.Join(cg.dir, "pids.max")
-		if err := os.WriteFile(pidsFile, []byte(strconv.Itoa(pids)), 0644); err != nil {
-			return err
-		}
+	if pids == 0 {
+		return nil
 	}
-	return nil
+	return writeLimit(filepath.Join(cg.dir, "pids.max"), int64(pids), "max")
 }
 
-// SetCPULimit sets number of CPU for the CGroups
+// SetCPULimit sets number of CPU for the CGroups, as a quota of cpus
+// periods in cpu.max
 func (cg cgroupsv2) SetCPULimit(cpus float64) error {
-	if int(cpus) > 0 && int(cpus) < runtime.NumCPU() {
-		cpuFile := filepath.Join(cg.dir, "cpu.max")
-		cpuVal := fmt.Sprintf("%d%d", int(cpus*constants.DefaultCfsPeriod),
-			constants.DefaultCfsPeriod)
-		if err := os.WriteFile(cpuFile, []byte(cpuVal), 0644); err != nil {
-			return err
+	if cpus == 0 {
+		return nil
+	}
+	quota := "max"
+	if cpus > 0 {
+		quota = strconv.FormatInt(cpuQuota(cpus), 10)
+	}
+	cpuFile := filepath.Join(cg.dir, "cpu.max")
+	cpuVal := fmt.Sprintf("%s %d", quota, constants.DefaultCfsPeriod)
+	return os.WriteFile(cpuFile, []byte(cpuVal), 0644)
+}
+
+// SetCPUQuota writes the quota and period to cpu.max, keeping the
+// current value of the unset one
+func (cg cgroupsv2) SetCPUQuota(quota, period int64) error {
+	if quota == 0 && period == 0 {
+		return nil
+	}
+	cpuFile := filepath.Join(cg.dir, "cpu.max")
+	current, err := os.ReadFile(cpuFile)
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(string(current))
+	if len(fields) != 2 {
+		return errors.Errorf("invalid cpu.max %q", current)
+	}
+	if quota != 0 {
+		fields[0] = formatLimit(quota, "max")
+	}
+	if period > 0 {
+		fields[1] = strconv.FormatInt(period, 10)
+	}
+	return os.WriteFile(cpuFile, []byte(strings.Join(fields, " ")), 0644)
+}
+
+// SetCPUShares writes the shares, converted to a weight, to cpu.weight
+func (cg cgroupsv2) SetCPUShares(shares uint64) error {
+	return cg.SetCPUWeight(SharesToWeight(shares))
+}
+
+// SetCPUWeight writes the weight to cpu.weight
+func (cg cgroupsv2) SetCPUWeight(weight uint64) error {
+	if weight == 0 {
+		return nil
+	}
+	return writeLimit(filepath.Join(cg.dir, "cpu.weight"), int64(weight), "")
+}
+
+// SetCpusetCPUs writes the CPUs list to cpuset.cpus
+func (cg cgroupsv2) SetCpusetCPUs(cpus string) error {
+	return cg.setCpuset("cpuset.cpus", cpus)
+}
+
+// SetCpusetMems writes the memory nodes list to cpuset.mems
+func (cg cgroupsv2) SetCpusetMems(mems string) error {
+	return cg.setCpuset("cpuset.mems", mems)
+}
+
+func (cg cgroupsv2) setCpuset(file, list string) error {
+	if list == "" {
+		return nil
+	}
+	path := filepath.Join(cg.dir, file)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return errors.Errorf("unable to set %s, the cpuset controller isn't enabled", file)
+	}
+	if err := os.WriteFile(path, []byte(list), 0644); err != nil {
+		return errors.Wrapf(err, "unable to set %s to %s", file, list)
+	}
+	return nil
+}
+
+// SetBlkioWeight writes the weight to io.bfq.weight with the BFQ
+// scheduler, which has the cgroup v1 range, or converted to io.weight
+func (cg cgroupsv2) SetBlkioWeight(weight uint16) error {
+	if weight == 0 {
+		return nil
+	}
+	if fileExists(cg.dir, "io.bfq.weight") {
+		return writeWeight(cg.dir, "io.bfq.weight", uint64(weight))
+	}
+	return writeWeight(cg.dir, "io.weight", BlkioWeightToIOWeight(weight))
+}
+
+// SetBlkioThrottle writes the rate limits to io.max, one line per
+// device with its limits: rbps, wbps, riops and wiops
+func (cg cgroupsv2) SetBlkioThrottle(throttle BlkioThrottle) error {
+	var devices []string
+	limits := make(map[string][]string)
+	for _, limit := range []struct {
+		key     string
+		devices []ThrottleDevice
+	}{
+		{"rbps", throttle.ReadBps},
+		{"wbps", throttle.WriteBps},
+		{"riops", throttle.ReadIOPS},
+		{"wiops", throttle.WriteIOPS},
+	} {
+		for _, d := range limit.devices {
+			device := fmt.Sprintf("%d:%d", d.Major, d.Minor)
+			if _, ok := limits[device]; !ok {
+				devices = append(devices, device)
+			}
+			rate := "max"
+			if d.Rate > 0 {
+				rate = strconv.FormatUint(d.Rate, 10)
+			}
+			limits[device] = append(limits[device], limit.key+"="+rate)
+		}
+	}
+	if len(devices) == 0 {
+		return nil
+	}
+	if !fileExists(cg.dir, "io.max") {
+		return errors.New("unable to throttle block I/O, the io controller isn't enabled")
+	}
+	for _, device := range devices {
+		line := device + " " + strings.Join(limits[device], " ")
+		if err := os.WriteFile(filepath.Join(cg.dir, "io.max"), []byte(line), 0644); err != nil {
+			return errors.Wrapf(err, "unable to write %s to io.max", line)
 		}
 	}
 	return nil
 }
 
+// SetDeviceRules attaches a BPF program which filters device
+// access, cgroups v2 have no device controller files.
+func (cg cgroupsv2) SetDeviceRules(rules []DeviceRule) error {
+	return attachDeviceFilter(cg.dir, rules)
+}
+
 // AddProcess adds pids into a CGroup
 func (cg cgroupsv2) AddProcess() error {
 	// Get pid
@@ -87,26 +298,210 @@ func (cg cgroupsv2) AddProcess() error {
 	return os.WriteFile(procsFile, []byte(strconv.Itoa(pid)), 0700)
 }
 
-// Remove removes CGroups
+// Remove removes CGroups and its sub groups, deepest first
 // It will only works if there is no process running in the CGroups
 func (cg cgroupsv2) Remove() {
-	os.Remove(cg.dir)
+	dirs, err := cg.groups()
+	if err != nil {
+		return
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Remove(dirs[i])
+	}
 }
 
-// GetPids returns slice of pids running on CGroups
+// GetPids returns slice of pids running on CGroups and its sub groups,
+// which a delegated CGroups may have.
 func (cg cgroupsv2) GetPids() ([]string, error) {
 	var pids []string
-	procsFile, err := os.Open(filepath.Join(cg.dir, "cgroup.procs"))
+	dirs, err := cg.groups()
 	if err != nil {
 		return pids, err
 	}
-	defer procsFile.Close()
 
-	scanner := bufio.NewScanner(procsFile)
-	for scanner.Scan() {
-		pid := scanner.Text()
-		pids = append(pids, pid)
+	for _, dir := range dirs {
+		procsFile, err := os.Open(filepath.Join(dir, "cgroup.procs"))
+		if err != nil {
+			return pids, err
+		}
+
+		scanner := bufio.NewScanner(procsFile)
+		for scanner.Scan() {
+			pid := scanner.Text()
+			pids = append(pids, pid)
+		}
+		procsFile.Close()
 	}
 
 	return pids, nil
 }
+
+// groups returns the CGroups directory and its sub groups, parents first
+func (cg cgroupsv2) groups() ([]string, error) {
+	var dirs []string
+	err := filepath.WalkDir(cg.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	return dirs, err
+}
+
+// Mount mounts the cgroup2 filesystem at target
+func (cg cgroupsv2) Mount(target string, readOnly bool) (filesystem.Unmounter, error) {
+	flag := uintptr(syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC)
+	if readOnly {
+		flag |= syscall.MS_RDONLY
+	}
+	return filesystem.Mount(filesystem.MountOption{
+		Source: "cgroup2", Target: target, Type: "cgroup2", Flag: flag,
+	})
+}
+
+// Delegate moves the process to an init leaf group and enables the
+// available controllers for the subtree: a group with processes can't
+// distribute resources to its children.
+func (cg cgroupsv2) Delegate() error {
+	initDir := filepath.Join(cg.dir, "init")
+	if err := utils.CreateDir(initDir); err != nil {
+		return err
+	}
+	procsFile := filepath.Join(initDir, "cgroup.procs")
+	if err := os.WriteFile(procsFile, []byte(strconv.Itoa(os.Getpid())), 0700); err != nil {
+		return errors.Wrap(err, "unable to move process to init group")
+	}
+
+	controllers, err := os.ReadFile(filepath.Join(cg.dir, "cgroup.controllers"))
+	if err != nil {
+		return err
+	}
+	var enable []string
+	for _, controller := range strings.Fields(string(controllers)) {
+		enable = append(enable, "+"+controller)
+	}
+	if len(enable) == 0 {
+		return nil
+	}
+	return os.WriteFile(filepath.Join(cg.dir, "cgroup.subtree_control"),
+		[]byte(strings.Join(enable, " ")), 0644)
+}
+
+// Freeze writes 1 to cgroup.freeze, the CGroups is frozen once
+// cgroup.events reports it
+func (cg cgroupsv2) Freeze() error {
+	return cg.setFrozen(true)
+}
+
+// Thaw writes 0 to cgroup.freeze
+func (cg cgroupsv2) Thaw() error {
+	return cg.setFrozen(false)
+}
+
+// setFrozen writes to cgroup.freeze and waits for cgroup.events
+func (cg cgroupsv2) setFrozen(frozen bool) error {
+	value := "0"
+	if frozen {
+		value = "1"
+	}
+	if err := os.WriteFile(filepath.Join(cg.dir, "cgroup.freeze"), []byte(value), 0644); err != nil {
+		return errors.Wrap(err, "unable to write cgroup.freeze")
+	}
+	return waitFreezerState(cg.Frozen, frozen)
+}
+
+// Frozen reports whether cgroup.events has "frozen 1"
+func (cg cgroupsv2) Frozen() (bool, error) {
+	frozen, err := readKeyValue(filepath.Join(cg.dir, "cgroup.events"), "frozen")
+	return frozen == 1, err
+}
+
+// OOMKillCount returns the oom_kill counter of memory.events
+func (cg cgroupsv2) OOMKillCount() (int, error) {
+	return readKeyValue(filepath.Join(cg.dir, "memory.events"), "oom_kill")
+}
+
+// Paths returns the CGroups directory
+func (cg cgroupsv2) Paths() map[string]string {
+	return map[string]string{"unified": cg.dir}
+}
+
+// Stats reads cpu.stat, memory.current, memory.max, memory.stat and
+// memory.peak, pids.current, pids.max and pids.peak, and io.stat.
+func (cg cgroupsv2) Stats() (*Stats, error) {
+	var (
+		stats Stats
+		err   error
+	)
+	cpuStat, err := readKeyValues(filepath.Join(cg.dir, "cpu.stat"))
+	if err != nil {
+		return nil, err
+	}
+	stats.CPU.Usage = cpuStat["usage_usec"] * uint64(time.Microsecond)
+	stats.CPU.User = cpuStat["user_usec"] * uint64(time.Microsecond)
+	stats.CPU.System = cpuStat["system_usec"] * uint64(time.Microsecond)
+
+	if stats.Memory.Usage, err = readUint(filepath.Join(cg.dir, "memory.current")); err != nil {
+		return nil, err
+	}
+	if stats.Memory.Limit, err = readUint(filepath.Join(cg.dir, "memory.max")); err != nil {
+		return nil, err
+	}
+	memStat, err := readKeyValues(filepath.Join(cg.dir, "memory.stat"))
+	if err != nil {
+		return nil, err
+	}
+	stats.Memory.Cache = memStat["file"]
+	// memory.peak is available since Linux 5.19
+	if stats.Memory.Peak, err = readUint(filepath.Join(cg.dir, "memory.peak")); ignoreNotExist(err) != nil {
+		return nil, err
+	}
+
+	if stats.Pids.Current, err = readUint(filepath.Join(cg.dir, "pids.current")); err != nil {
+		return nil, err
+	}
+	if stats.Pids.Limit, err = readUint(filepath.Join(cg.dir, "pids.max")); err != nil {
+		return nil, err
+	}
+	if stats.Pids.Peak, err = readUint(filepath.Join(cg.dir, "pids.peak")); ignoreNotExist(err) != nil {
+		return nil, err
+	}
+
+	stats.IO, err = readIOStats(filepath.Join(cg.dir, "io.stat"))
+	return &stats, ignoreNotExist(err)
+}
+
+// readIOStats sums the rbytes and wbytes of the devices in io.stat:
+// "major:minor key=value..." lines.
+func readIOStats(file string) (IOStats, error) {
+	var stats IOStats
+	f, err := os.Open(file)
+	if err != nil {
+		return stats, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		for _, field := range strings.Fields(scanner.Text()) {
+			key, value, ok := strings.Cut(field, "=")
+			if !ok {
+				continue
+			}
+			v, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				continue
+			}
+			switch key {
+			case "rbytes":
+				stats.ReadBytes += v
+			case "wbytes":
+				stats.WriteBytes += v
+			}
+		}
+	}
+	return stats, scanner.Err()
+}
@@ -3,11 +3,6 @@ package constants
 const (
 	// General
 	KokerApp             = "koker"
-	KokerHomePath        = "/var/lib/" + KokerApp
-	KokerTempPath        = KokerHomePath + "/tmp"
-	KokerImagesPath      = KokerHomePath + "/images"
-	KokerContainersPath  = KokerHomePath + "/containers"
-	KokerNetNsPath       = KokerHomePath + "/netns"
 	KokerBridgeName      = "koker0"
 	KokerBridgeIPPrefix  = "172.69."
 	KokerBridgeIPCIDR    = KokerBridgeIPPrefix + "0.0/16"
@@ -22,11 +17,17 @@ const (
 
 	// Template
 	ContainersTemplate = `
-CONTAINER ID{{"\t\t"}}IMAGE       {{"\t\t"}}COMMAND
+CONTAINER ID{{"\t\t"}}IMAGE       {{"\t\t"}}STATUS           {{"\t"}}COMMAND
 {{ range $container := . }}
-{{ $container.id }}{{"\t"}}{{ printf "%.12s" $container.image }}{{"\t\t"}}{{ $container.cmd }}
+{{ $container.id }}{{"\t"}}{{ printf "%.12s" $container.image }}{{"\t\t"}}{{ printf "%-17s" $container.status }}{{"\t"}}{{ $container.cmd }}
 {{ end }}
 `
+	ProcessesTemplate = `{{ printf "%-8s %-8s %-12s %-10s %-10s %s" "PID" "NSPID" "USER" "TIME" "RSS" "CMD" }}
+{{ range $process := . }}{{ printf "%-8s %-8s %-12s %-10s %-10s %s" $process.pid $process.nspid $process.user $process.time $process.rss $process.cmd }}
+{{ end }}`
+	StatsTemplate = `{{ printf "%-22s %-8s %-22s %-8s %-22s %-22s %s" "CONTAINER ID" "CPU %" "MEM USAGE / LIMIT" "MEM %" "NET I/O" "BLOCK I/O" "PIDS" }}
+{{ range $stats := . }}{{ printf "%-22s %-8s %-22s %-8s %-22s %-22s %s" $stats.id $stats.cpu $stats.mem $stats.memp $stats.net $stats.block $stats.pids }}
+{{ end }}`
 	ImagesTemplate = `
 REPOSITORY{{"\t\t"}}TAG{{"\t\t"}}IMAGE ID
 {{ range $image := . }}
@@ -34,3 +35,23 @@ REPOSITORY{{"\t\t"}}TAG{{"\t\t"}}IMAGE ID
 {{ end }}
 `
 )
+
+// Koker directories. They are variables because rootless mode
+// keeps its state under the user's data directory instead,
+// see SetKokerHomePath.
+var (
+	KokerHomePath       = "/var/lib/" + KokerApp
+	KokerTempPath       = KokerHomePath + "/tmp"
+	KokerImagesPath     = KokerHomePath + "/images"
+	KokerContainersPath = KokerHomePath + "/containers"
+	KokerNetNsPath      = KokerHomePath + "/netns"
+)
+
+// SetKokerHomePath moves all koker directories under home
+func SetKokerHomePath(home string) {
+	KokerHomePath = home
+	KokerTempPath = KokerHomePath + "/tmp"
+	KokerImagesPath = KokerHomePath + "/images"
+	KokerContainersPath = KokerHomePath + "/containers"
+	KokerNetNsPath = KokerHomePath + "/netns"
+}
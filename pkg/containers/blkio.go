@@ -0,0 +1,94 @@
+package containers
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/ntk148v/koker/pkg/cgroups"
+)
+
+// ThrottleDevice is the rate limit of a host block device, in bytes or
+// operations per second. The device numbers are resolved when the
+// limit is set, they may change across reboots.
+type ThrottleDevice struct {
+	Path string `json:"path"`
+	Rate uint64 `json:"rate"`
+}
+
+// ParseThrottleDevice parses a rate limit in path:rate format. Byte
+// rates take a unit, such as 10mb, and are in bytes without; rates of
+// operations are numbers.
+func ParseThrottleDevice(s string, bytes bool) (ThrottleDevice, error) {
+	var d ThrottleDevice
+	path, rate, ok := strings.Cut(s, ":")
+	if !ok {
+		return d, errors.Errorf("invalid device rate %q, expected path:rate", s)
+	}
+	d.Path = path
+	if bytes {
+		b, err := parseBytes(rate, "b")
+		if err != nil || b < 0 {
+			return d, errors.Errorf("invalid device rate %q, expected a size per second", s)
+		}
+		d.Rate = uint64(b)
+	} else {
+		var err error
+		if d.Rate, err = strconv.ParseUint(rate, 10, 64); err != nil {
+			return d, errors.Errorf("invalid device rate %q, expected a number of operations per second", s)
+		}
+	}
+	if _, err := d.throttle(); err != nil {
+		return d, err
+	}
+	return d, nil
+}
+
+// ParseThrottleDevices parses a list of device rate limits
+func ParseThrottleDevices(ss []string, bytes bool) ([]ThrottleDevice, error) {
+	var devices []ThrottleDevice
+	for _, s := range ss {
+		d, err := ParseThrottleDevice(s, bytes)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, d)
+	}
+	return devices, nil
+}
+
+// throttle returns the rate limit of the device numbers
+func (d ThrottleDevice) throttle() (cgroups.ThrottleDevice, error) {
+	rule, err := deviceRule(d.Path, "")
+	if err != nil {
+		return cgroups.ThrottleDevice{}, err
+	}
+	if rule.Type != 'b' {
+		return cgroups.ThrottleDevice{}, errors.Errorf("%s is not a block device", d.Path)
+	}
+	return cgroups.ThrottleDevice{Major: rule.Major, Minor: rule.Minor, Rate: d.Rate}, nil
+}
+
+// blkioThrottle resolves the block device rate limits of the container
+func (hc *HostConfig) blkioThrottle() (cgroups.BlkioThrottle, error) {
+	var throttle cgroups.BlkioThrottle
+	for _, limit := range []struct {
+		devices []ThrottleDevice
+		dest    *[]cgroups.ThrottleDevice
+	}{
+		{hc.DeviceReadBps, &throttle.ReadBps},
+		{hc.DeviceWriteBps, &throttle.WriteBps},
+		{hc.DeviceReadIOps, &throttle.ReadIOPS},
+		{hc.DeviceWriteIOps, &throttle.WriteIOPS},
+	} {
+		for _, d := range limit.devices {
+			t, err := d.throttle()
+			if err != nil {
+				return throttle, err
+			}
+			*limit.dest = append(*limit.dest, t)
+		}
+	}
+	return throttle, nil
+}
@@ -0,0 +1,67 @@
+package containers
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+
+	"github.com/ntk148v/koker/pkg/cgroups"
+	"github.com/ntk148v/koker/pkg/filesystem"
+)
+
+// Cgroup namespace modes of --cgroupns
+const (
+	CgroupnsPrivate = "private"
+	CgroupnsHost    = "host"
+)
+
+// cgroupMountpoint is where the container's cgroup is mounted
+const cgroupMountpoint = "/sys/fs/cgroup"
+
+// privateCgroupns reports whether the container has its own cgroup namespace
+func (hc *HostConfig) privateCgroupns() bool {
+	return hc.CgroupnsMode == "" || hc.CgroupnsMode == CgroupnsPrivate
+}
+
+// validateCgroupns checks the cgroup namespace options
+func (hc *HostConfig) validateCgroupns() error {
+	if !hc.privateCgroupns() && hc.CgroupnsMode != CgroupnsHost {
+		return errors.Errorf("invalid cgroup namespace mode %q", hc.CgroupnsMode)
+	}
+	if hc.CgroupDelegate {
+		if !hc.privateCgroupns() {
+			return errors.New("cgroup delegation requires a private cgroup namespace")
+		}
+		if mode, err := cgroups.Mode(); err != nil || mode != cgroups.Unified {
+			return errors.New("cgroup delegation requires cgroups v2 (unified mode)")
+		}
+	}
+	return nil
+}
+
+// unshareCgroupns moves the calling thread to a new cgroup namespace
+// whose root is the container's cgroup, it must be added to it first.
+// The process is then moved to a leaf of the cgroup if it is delegated.
+func (c *Container) unshareCgroupns() error {
+	if _, err := os.Stat("/proc/self/ns/cgroup"); os.IsNotExist(err) {
+		return errors.New("cgroup namespaces aren't supported by the kernel, use --cgroupns host")
+	}
+	c.log.Info().Msg("Unshare cgroup namespace")
+	if err := unix.Unshare(unix.CLONE_NEWCGROUP); err != nil {
+		return errors.Wrap(err, "unable to unshare cgroup namespace")
+	}
+	if !c.HostConfig.CgroupDelegate {
+		return nil
+	}
+	c.log.Debug().Msg("Delegate container's cgroup")
+	return c.cg.Delegate()
+}
+
+// mountCgroupfs mounts the container's cgroup at /sys/fs/cgroup,
+// read-only unless the cgroup is delegated or the container privileged.
+func (c *Container) mountCgroupfs() (filesystem.Unmounter, error) {
+	hc := c.HostConfig
+	c.log.Debug().Bool("delegate", hc.CgroupDelegate).Msg("Mount container's cgroup")
+	return c.cg.Mount(cgroupMountpoint, !hc.CgroupDelegate && !hc.Privileged)
+}
@@ -5,14 +5,18 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
-	"strconv"
+	"runtime"
+	"strings"
+	"sync"
 	"syscall"
 
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"golang.org/x/sys/unix"
 
 	"github.com/ntk148v/koker/pkg/cgroups"
 	"github.com/ntk148v/koker/pkg/constants"
@@ -20,10 +24,13 @@ import (
 	"github.com/ntk148v/koker/pkg/images"
 	"github.com/ntk148v/koker/pkg/network"
 	"github.com/ntk148v/koker/pkg/reexec"
+	"github.com/ntk148v/koker/pkg/userns"
 	"github.com/ntk148v/koker/pkg/utils"
 )
 
-func ListAllContainers() ([]map[string]string, error) {
+// ListAllContainers returns the running containers, with the exited
+// ones if showAll is set
+func ListAllContainers(showAll bool) ([]map[string]string, error) {
 	all := make([]map[string]string, 0)
 	files, err := os.ReadDir(constants.KokerContainersPath)
 	if err != nil {
@@ -37,41 +44,94 @@ func ListAllContainers() ([]map[string]string, error) {
 
 		// Load container config to retrieve config
 		c, _ := NewContainer(file.Name())
-		if err := c.LoadConfig(); err != nil {
+		if err := c.loadHostConfig(); err != nil {
 			return all, err
 		}
-
-		// Get cmd
-		cmd, err := c.getCmd()
+		state, err := c.loadState()
 		if err != nil {
 			return all, err
 		}
+		if !showAll && state.status() == StatusExited {
+			continue
+		}
+		// The image config is copied once the root filesystem is prepared
+		if err := c.loadImageConfig(); err != nil && !os.IsNotExist(err) {
+			return all, err
+		}
+
+		// Get cmd, the running one if any
+		cmd := strings.Join(c.commandArgs(c.HostConfig.Cmd), " ")
+		if state.status() == StatusRunning {
+			if running, err := c.getCmd(); err == nil {
+				cmd = running
+			}
+		}
 
 		all = append(all, map[string]string{
-			"id":    c.ID,
-			"image": c.Config.Image[8:],
-			"cmd":   cmd,
+			"id":     c.ID,
+			"image":  c.imageName(),
+			"status": c.statusText(state),
+			"cmd":    cmd,
 		})
 	}
 
 	return all, nil
 }
 
+// statusText describes the status of a container for `container ls`
+func (c *Container) statusText(state *State) string {
+	status := state.status()
+	switch status {
+	case StatusRunning:
+		if c.paused() {
+			return StatusPaused
+		}
+		if state.Health != nil {
+			return fmt.Sprintf("%s (%s)", status, state.Health.Status)
+		}
+	case StatusRestarting:
+		return fmt.Sprintf("%s (%d)", status, state.RestartCount)
+	case StatusExited:
+		return fmt.Sprintf("%s (%d)", status, state.ExitCode)
+	}
+	return status
+}
+
+// imageName returns what the container was run from: the image id
+// or the root filesystem directory or tarball.
+func (c *Container) imageName() string {
+	if c.HostConfig.RootFSTar != "" {
+		return c.HostConfig.RootFSTar
+	}
+	if c.HostConfig.RootFSPath != "" {
+		return c.HostConfig.RootFSPath
+	}
+	return strings.TrimPrefix(c.Config.Image, "sha256:")
+}
+
 type Container struct {
-	Config *v1.Config
-	ID     string
-	RootFS string
-	log    zerolog.Logger
-	cg     cgroups.CGroups
+	Config     *v1.Config
+	HostConfig *HostConfig
+	ID         string
+	RootFS     string
+	log        zerolog.Logger
+	cg         cgroups.CGroups
+	ipAddress  string
+	macAddress string
+	// state is kept by the monitor, see updateState
+	state   *State
+	stateMu sync.Mutex
 }
 
-// NewContainer returns a new Container instance with random digest
+// NewContainer returns a new Container instance with random digest. Its
+// cgroups are only created by Run.
 func NewContainer(id string) (*Container, error) {
 	c := &Container{
-		Config: new(v1.Config),
-		RootFS: filepath.Join(constants.KokerContainersPath, id, "mnt"),
-		ID:     id,
-		log:    log.With().Str("container", id).Logger(),
+		Config:     new(v1.Config),
+		HostConfig: NewHostConfig(""),
+		RootFS:     filepath.Join(constants.KokerContainersPath, id, "mnt"),
+		ID:         id,
+		log:        log.With().Str("container", id).Logger(),
 	}
 	cg, err := cgroups.NewCGroups(constants.KokerApp + "/" + id)
 	if err == nil {
@@ -80,97 +140,218 @@ func NewContainer(id string) (*Container, error) {
 	return c, err
 }
 
-func (c *Container) Run(src string, cmds []string, hostname string, mem, swap, pids int, cpus float64, quiet, debug bool) error {
+// Run creates and runs a container with the given host config
+func (c *Container) Run(hc *HostConfig, cmds []string, quiet, debug bool) (err error) {
+	c.HostConfig = hc
+	hc.Cmd = cmds
+	// SIGTERM stops the container, even while it is being prepared
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGTERM)
+	defer signal.Stop(sigc)
 	defer func() {
-		if err := c.delete(); err != nil {
-			c.log.Error().Err(err).Msg("Clean up container failed")
+		// Detached containers are kept until they are removed
+		remove := c.delete
+		if hc.Detach {
+			remove = c.cleanup
+		}
+		if rerr := remove(); rerr != nil {
+			// The container's error, or exit code, comes first
+			if err != nil {
+				c.log.Error().Err(rerr).Msg("Clean up container failed")
+				return
+			}
+			err = errors.Wrap(rerr, "unable to clean up container")
 		}
 	}()
-	// Setup network
-	delNet, err := c.setupNetwork(constants.KokerBridgeName)
-	if err != nil {
-		return errors.Wrap(err, "unable to setup network")
+
+	rootless := userns.Rootless()
+	if rootless {
+		if err := hc.validateRootlessNamespaces(); err != nil {
+			return err
+		}
+	}
+	if len(hc.TimeOffsets) > 0 {
+		if err := checkTimens(); err != nil {
+			return err
+		}
+	}
+	if err := c.cg.Create(); err != nil {
+		return errors.Wrap(err, "unable to create container cgroups")
 	}
 
-	defer func() {
-		if err := delNet(); err != nil {
-			c.log.Error().Err(err).Msg("Unmount network namespace failed")
+	if hc.UTSMode != "" {
+		hostname, err := c.sharedHostname()
+		if err != nil {
+			return errors.Wrap(err, "unable to get hostname of shared UTS namespace")
 		}
-	}()
+		hc.Hostname = hostname
+	} else if hc.Hostname == "" {
+		hc.Hostname = c.ID[:12]
+	}
 
-	// Get image
-	img, err := images.NewImage(src)
+	// Namespaces of other containers are joined before starting the child
+	joined, err := c.joinedNamespaces()
 	if err != nil {
-		return errors.Wrap(err, "unable to get image")
+		return err
+	}
+
+	if !hc.bridgeNetwork() {
+		c.log.Info().Str("network", hc.NetworkMode).Msg("Skip container network setup")
+	} else if rootless {
+		// Without a privileged helper, we can't create veth pairs
+		// nor touch the bridge: the container only gets loopback.
+		c.log.Warn().Msg("Rootless mode, container network is limited to loopback")
+	} else {
+		if err := setupBridge(); err != nil {
+			return err
+		}
+
+		// Setup network
+		delNet, err := c.setupNetwork(constants.KokerBridgeName)
+		if err != nil {
+			return errors.Wrap(err, "unable to setup network")
+		}
+
+		c.updateState(func(s *State) {
+			s.Network = c.networkSettings()
+		})
+		defer func() {
+			c.updateState(func(s *State) {
+				s.Network = nil
+			})
+			if err := delNet(); err != nil {
+				c.log.Error().Err(err).Msg("Unmount network namespace failed")
+			}
+		}()
 	}
 
-	// Mount overlayfs
-	unmount, err := c.mountOverlayFS(img)
+	// Get root filesystem layers, from the image or a plain directory
+	layers, err := c.prepareRootFS()
 	if err != nil {
-		return errors.Wrap(err, "unable to mount overlayfs")
+		return errors.Wrap(err, "unable to prepare root filesystem")
+	}
+	if err := c.loadImageConfig(); err != nil {
+		return errors.Wrap(err, "unable to load container config")
 	}
-	defer func() {
-		if err := unmount(); err != nil {
-			c.log.Error().Err(err).Msg("Unmount overlayfs failed")
-		}
-	}()
 
-	// Format child options
-	var opts []string
-	if mem > 0 {
-		opts = append(opts, "--mem="+strconv.Itoa(mem))
+	// Unprivileged users can only mount overlayfs inside the
+	// container's user namespace, the child will do it.
+	if !rootless {
+		// Mount overlayfs
+		unmount, err := c.mountOverlayFS(layers)
+		if err != nil {
+			return errors.Wrap(err, "unable to mount overlayfs")
+		}
+		defer func() {
+			if err := unmount(); err != nil {
+				c.log.Error().Err(err).Msg("Unmount overlayfs failed")
+			}
+		}()
 	}
-	if pids > 0 {
-		opts = append(opts, "--pids="+strconv.Itoa(pids))
+
+	if err := c.generateEtcFiles(c.ipAddress); err != nil {
+		return err
 	}
-	if cpus > 0 {
-		opts = append(opts, "--cpus="+strconv.FormatFloat(cpus, 'f', 1, 64))
+
+	// The child reads its options from the host config file
+	if err := c.saveHostConfig(); err != nil {
+		return errors.Wrap(err, "unable to save host config")
 	}
-	opts = append(opts, "--hostname="+hostname)
-	args := append([]string{c.ID}, cmds...)
-	args = append(opts, args...)
-	args = append([]string{"container", "child"}, args...)
+
+	args := append([]string{"container", "child", c.ID}, cmds...)
 	// NOTE(kiennt26): Have to pass quiet and debug again as we re-run ourselves
 	// If not set, quiet and debug mode won't work properly.
-	if quiet {
-		args = append([]string{"-q"}, args...)
-	} else {
-		if debug {
-			args = append([]string{"-D"}, args...)
+	args = append(logArgs(quiet, debug), args...)
+
+	// The child is started again when the container restarts
+	err = c.supervise(sigc, func() (*exec.Cmd, error) {
+		// /proc/self/exe - a special file containing an in-memory image of the current executable.
+		// In other words, we re-run ourselves, but passing childs as the first agrument.
+		cmd := reexec.Command(args...)
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Cloneflags: hc.cloneFlags(rootless),
+		}
+		if !rootless {
+			return cmd, startInNamespaces(joined, cmd.Start)
 		}
-	}
 
-	// /proc/self/exe - a special file containing an in-memory image of the current executable.
-	// In other words, we re-run ourselves, but passing childs as the first agrument.
-	cmd := reexec.Command(args...)
-	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
-	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Cloneflags: syscall.CLONE_NEWNS |
-			syscall.CLONE_NEWUTS |
-			syscall.CLONE_NEWIPC |
-			syscall.CLONE_NEWPID,
-	}
-	return cmd.Run()
+		c.log.Info().Msg("Start child in a new user namespace")
+		if err := userns.Start(cmd); err != nil {
+			return cmd, errors.Wrap(err, "unable to start child in a user namespace")
+		}
+		return cmd, nil
+	})
+	c.recordUsage()
+	return err
 }
 
 // RunChild runs child command which is called from Run()
-func (c *Container) RunChild(cmdArgs []string, hostname string, mem, swap, pids int, cpus float64) error {
-	// Set hostname
-	c.setHostname(hostname)
+func (c *Container) RunChild(cmdArgs []string) error {
+	hc := c.HostConfig
+	if userns.Rootless() {
+		// Mount the root filesystem inside the user namespace
+		layers, err := c.rootFSLayers()
+		if err != nil {
+			return errors.Wrap(err, "unable to get root filesystem layers")
+		}
+		unmount, err := c.mountRootFS(layers)
+		if err != nil {
+			return errors.Wrap(err, "unable to mount root filesystem")
+		}
+		defer func() {
+			if err := unmount(); err != nil {
+				c.log.Error().Err(err).Msg("Unmount root filesystem failed")
+			}
+		}()
+	}
+
+	// A network namespace created with the child only has loopback
+	if hc.cloneFlags(userns.Rootless())&syscall.CLONE_NEWNET != 0 {
+		if err := network.LinkSetup("lo"); err != nil {
+			return errors.Wrap(err, "unable to setup loopback")
+		}
+	}
+
+	// Set hostname, unless the UTS namespace is shared
+	if hc.UTSMode == "" {
+		c.setHostname(hc.Hostname)
+	}
 
 	// Setup cgroups
 	if err := c.cg.AddProcess(); err != nil {
 		return err
 	}
 
-	if err := c.setLimit(mem, swap, pids, cpus); err != nil {
+	if err := c.setLimit(hc); err != nil {
 		return errors.Wrap(err, "unable to set container's limit")
 	}
 
-	// Copy nameserver
-	if err := c.copyNameServerConfig(); err != nil {
-		return errors.Wrap(err, "unable to copy name server config")
+	if err := c.setDeviceRules(); err != nil {
+		return errors.Wrap(err, "unable to set container's device rules")
+	}
+
+	// Mount /dev with the container's devices
+	unmountDev, err := c.mountDev()
+	if err != nil {
+		return errors.Wrap(err, "unable to mount /dev")
 	}
+	defer func() {
+		if err := unmountDev(); err != nil {
+			c.log.Error().Err(err).Msg("Unmount /dev failed")
+		}
+	}()
+
+	// Mount hosts, hostname and nameserver config
+	unmountEtc, err := c.mountEtcFiles()
+	if err != nil {
+		return errors.Wrap(err, "unable to mount /etc files")
+	}
+	defer func() {
+		if err := unmountEtc(); err != nil {
+			c.log.Error().Err(err).Msg("Unmount /etc files failed")
+		}
+	}()
 
 	// Execute command
 	return c.ExecuteCommand(cmdArgs, true)
@@ -178,7 +359,32 @@ func (c *Container) RunChild(cmdArgs []string, hostname string, mem, swap, pids
 
 func (c *Container) ExecuteCommand(cmdArgs []string, child bool) error {
 	c.log.Info().Msg("Execute command")
-	if child {
+	if !child {
+		// The command would wait for the container to be unpaused
+		if c.paused() {
+			return errors.Errorf("container %s is paused, unpause it first", c.ID)
+		}
+		if userns.Rootless() {
+			return c.executeRootless(cmdArgs)
+		}
+		return c.executeInContainer(cmdArgs)
+	}
+
+	// setns only changes the namespaces of the calling thread, stay on it
+	// until the command is started so that it inherits them.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	// The monitor stops the container with SIGTERM, until it exits. The
+	// first one is forwarded to the command once it is started.
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGTERM)
+	defer signal.Stop(sigc)
+	// The command is started from a thread restricted by the Landlock
+	// profile, which creates the time namespace itself
+	landlockABI := c.landlockABI()
+	timens := len(c.HostConfig.TimeOffsets) > 0
+	if !userns.Rootless() && c.HostConfig.bridgeNetwork() {
 		// Set network namespace
 		unset, err := c.setNetworkNamespace()
 		if err != nil {
@@ -189,18 +395,47 @@ func (c *Container) ExecuteCommand(cmdArgs []string, child bool) error {
 				c.log.Error().Err(err).Msg("Unset network namespace failed")
 			}
 		}()
-	} else {
-		pid, err := c.getMainPid()
-		if err != nil {
+	}
+	// The cgroup namespace root is the cgroup of the unsharing
+	// thread, the child has been added to the container's one.
+	if c.HostConfig.privateCgroupns() {
+		if err := c.unshareCgroupns(); err != nil {
+			return err
+		}
+	}
+	if timens && landlockABI == 0 {
+		if err := c.unshareTimens(); err != nil {
 			return err
 		}
+	}
 
-		// Set namespace
-		if err := utils.SetNamespace(pid, syscall.CLONE_NEWUTS|syscall.CLONE_NEWIPC|syscall.CLONE_NEWPID|syscall.CLONE_NEWNET); err != nil {
+	// The restricted thread joins the namespaces of this one
+	var namespaces map[int]*os.File
+	if landlockABI > 0 {
+		var err error
+		if namespaces, err = openThreadNamespaces(); err != nil {
 			return err
 		}
+		defer closeNamespaces(namespaces)
 	}
 
+	// Get back to the host root once the command exits, so that
+	// the mounts made by RunChild can be unmounted.
+	hostRoot, err := os.Open("/")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		defer hostRoot.Close()
+		if err := hostRoot.Chdir(); err != nil {
+			c.log.Error().Err(err).Msg("Change to host root failed")
+			return
+		}
+		if err := syscall.Chroot("."); err != nil {
+			c.log.Error().Err(err).Msg("Change to host root failed")
+		}
+	}()
+
 	// Change root
 	// calls chroot syscall for the given root filesystem
 	if err := syscall.Chroot(c.RootFS); err != nil {
@@ -215,39 +450,190 @@ func (c *Container) ExecuteCommand(cmdArgs []string, child bool) error {
 			c.Config.WorkingDir)
 	}
 
-	if child {
-		// Mount necessaries
-		mountPoints := []filesystem.MountOption{
-			{Source: "tmpfs", Target: "dev", Type: "tmpfs"},
-			{Source: "proc", Target: "proc", Type: "proc"},
-			{Source: "sysfs", Target: "sys", Type: "sysfs"},
-			{Source: "tmpfs", Target: "tmp", Type: "tmpfs"},
+	// Mount necessaries
+	// Privileged containers have a writable /sys,
+	// /dev has already been mounted by RunChild
+	sysFlag := uintptr(syscall.MS_RDONLY)
+	if c.HostConfig.Privileged {
+		sysFlag = 0
+	}
+	mountPoints := []filesystem.MountOption{
+		{Source: "proc", Target: "/proc", Type: "proc"},
+		{Source: "sysfs", Target: "/sys", Type: "sysfs", Flag: sysFlag},
+	}
+	mountPoints = append(mountPoints, c.tmpfsMountPoints("/")...)
+	unmount, err := filesystem.Mount(mountPoints...)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := unmount(); err != nil {
+			c.log.Error().Err(err).Msg("Unmount mountpoints (proc, sys,tmp, dev) failed")
 		}
-		unmount, err := filesystem.Mount(mountPoints...)
+	}()
+
+	if c.HostConfig.privateCgroupns() {
+		unmountCgroupfs, err := c.mountCgroupfs()
 		if err != nil {
-			return err
+			return errors.Wrap(err, "unable to mount cgroup filesystem")
 		}
 		defer func() {
-			if err := unmount(); err != nil {
-				c.log.Error().Err(err).Msg("Unmount mountpoints (proc, sys,tmp, dev) failed")
+			if err := unmountCgroupfs(); err != nil {
+				c.log.Error().Err(err).Msg("Unmount cgroup filesystem failed")
 			}
 		}()
 	}
 
+	// Sysctls apply to the namespaces of the writer
+	if err := c.setSysctls(); err != nil {
+		return err
+	}
+
 	var cmd *exec.Cmd
 
-	if len(cmdArgs) < 1 {
-		cmdArgs = append(cmdArgs, c.Config.Cmd...)
+	command, argv := utils.CmdAndArgs(c.commandArgs(cmdArgs))
+
+	if err := c.setProcessLimits(); err != nil {
+		return err
 	}
 
-	if len(c.Config.Entrypoint) > 0 {
-		cmdArgs = append(c.Config.Entrypoint, cmdArgs...)
+	c.log.Debug().Str("command", command).Msg("Execute command")
+	cmd = exec.Command(command, argv...)
+	cmd.Stderr = os.Stderr
+	cmd.Stdout = os.Stdout
+	cmd.Stdin = os.Stdin
+	cmd.Env = c.Config.Env
+	if landlockABI > 0 {
+		err = c.startRestricted(cmd, landlockABI, namespaces, timens)
+	} else {
+		err = cmd.Start()
+	}
+	if err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case sig := <-sigc:
+			cmd.Process.Signal(sig)
+		case <-done:
+		}
+	}()
+	return cmd.Wait()
+}
+
+// executeInContainer runs a command inside a running container, from a
+// thread which joins all its namespaces. Joining a mount namespace
+// requires a root and working directory which no other thread shares,
+// the thread unshares them and is never given back to the runtime.
+func (c *Container) executeInContainer(cmdArgs []string) error {
+	pid, err := c.getMainPid()
+	if err != nil {
+		return err
+	}
+	// The container's root in its mount namespace, where setns leaves
+	// us at the namespace's root
+	root, err := os.Open(filepath.Join("/proc", pid, "root"))
+	if err != nil {
+		return errors.Wrap(err, "unable to open container's root")
 	}
+	defer root.Close()
 
-	command, argv := utils.CmdAndArgs(cmdArgs)
+	if err := c.setProcessLimits(); err != nil {
+		return err
+	}
 
+	cmdc := make(chan *exec.Cmd, 1)
+	errc := make(chan error, 1)
+	go func() {
+		// Never unlocked, the thread terminates with the goroutine
+		runtime.LockOSThread()
+		cmd, err := c.startInNamespaces(pid, root, cmdArgs)
+		cmdc <- cmd
+		errc <- err
+	}()
+	cmd := <-cmdc
+	if err := <-errc; err != nil {
+		return err
+	}
+	return cmd.Wait()
+}
+
+// startInNamespaces starts a command in the namespaces of the process
+// pid, whose root directory is root. The calling thread is changed for
+// good.
+func (c *Container) startInNamespaces(pid string, root *os.File, cmdArgs []string) (*exec.Cmd, error) {
+	if err := unix.Unshare(unix.CLONE_FS); err != nil {
+		return nil, errors.Wrap(err, "unable to unshare filesystem attributes")
+	}
+	if err := utils.SetNamespace(pid, syscall.CLONE_NEWUTS|syscall.CLONE_NEWIPC|syscall.CLONE_NEWPID|syscall.CLONE_NEWNET); err != nil {
+		return nil, err
+	}
+	// Last, /proc may not be the host's one in the container's namespace
+	if err := utils.SetNamespace(pid, syscall.CLONE_NEWNS); err != nil {
+		return nil, err
+	}
+	if err := root.Chdir(); err != nil {
+		return nil, errors.Wrap(err, "unable to change to container's root")
+	}
+	if err := syscall.Chroot("."); err != nil {
+		return nil, errors.Wrap(err, "unable to change to container's root")
+	}
+	if c.Config.WorkingDir == "" {
+		c.Config.WorkingDir = "/"
+	}
+	if err := os.Chdir(c.Config.WorkingDir); err != nil {
+		return nil, errors.Wrapf(err, "unable to change working directory to %s",
+			c.Config.WorkingDir)
+	}
+	// The thread is discarded, it can be restricted itself
+	if abi := c.landlockABI(); abi > 0 {
+		if err := c.restrictThread(abi); err != nil {
+			return nil, err
+		}
+	}
+
+	command, argv := utils.CmdAndArgs(c.commandArgs(cmdArgs))
 	c.log.Debug().Str("command", command).Msg("Execute command")
-	cmd = exec.Command(command, argv...)
+	cmd := exec.Command(command, argv...)
+	cmd.Stderr = os.Stderr
+	cmd.Stdout = os.Stdout
+	cmd.Stdin = os.Stdin
+	cmd.Env = c.Config.Env
+	return cmd, cmd.Start()
+}
+
+// executeRootless runs a command inside a running rootless container.
+// Joining a user namespace requires a single-threaded process, which
+// the Go runtime never is, so it is delegated to nsenter(1).
+func (c *Container) executeRootless(cmdArgs []string) error {
+	// nsenter can't restrict the command it starts
+	if c.HostConfig.Landlock != nil {
+		return errors.New("rootless exec isn't supported with a landlock profile")
+	}
+	pid, err := c.getMainPid()
+	if err != nil {
+		return err
+	}
+	nsenter, err := exec.LookPath("nsenter")
+	if err != nil {
+		return errors.Wrap(err, "rootless exec requires nsenter")
+	}
+
+	if c.Config.WorkingDir == "" {
+		c.Config.WorkingDir = "/"
+	}
+	args := []string{"--target", pid, "--user", "--preserve-credentials", "--mount",
+		"--uts", "--ipc", "--net", "--pid", "--root", "--wd=" + c.Config.WorkingDir, "--"}
+	args = append(args, c.commandArgs(cmdArgs)...)
+
+	if err := c.setProcessLimits(); err != nil {
+		return err
+	}
+
+	c.log.Debug().Str("command", strings.Join(args, " ")).Msg("Execute command with nsenter")
+	cmd := exec.Command(nsenter, args...)
 	cmd.Stderr = os.Stderr
 	cmd.Stdout = os.Stdout
 	cmd.Stdin = os.Stdin
@@ -255,8 +641,70 @@ func (c *Container) ExecuteCommand(cmdArgs []string, child bool) error {
 	return cmd.Run()
 }
 
-// LoadConfig reads container config file
+// tmpfsMountPoints returns the container's tmpfs mounts: /tmp, /run on
+// a read-only root filesystem, and the --tmpfs ones which may override
+// both. root is where the container's root filesystem is seen from.
+func (c *Container) tmpfsMountPoints(root string) []filesystem.MountOption {
+	var mountPoints []filesystem.MountOption
+	tmpfs := make(map[string]bool)
+	for _, t := range c.HostConfig.Tmpfs {
+		tmpfs[t.Target] = true
+	}
+
+	if !tmpfs["/tmp"] {
+		mountPoints = append(mountPoints,
+			filesystem.MountOption{Source: "tmpfs", Target: "/tmp", Type: "tmpfs"})
+	}
+	if c.HostConfig.ReadOnly && !tmpfs["/run"] {
+		// Keep /run writable on a read-only root filesystem
+		if _, err := os.Stat(filepath.Join(root, "run")); err == nil {
+			mountPoints = append(mountPoints,
+				filesystem.MountOption{Source: "tmpfs", Target: "/run", Type: "tmpfs"})
+		} else {
+			c.log.Debug().Msg("No /run in read-only root filesystem, skip its tmpfs")
+		}
+	}
+	for _, t := range c.HostConfig.Tmpfs {
+		mountPoints = append(mountPoints, t.MountOption())
+	}
+	return mountPoints
+}
+
+// setProcessLimits sets the container's ulimits and OOM score adjustment
+// on the current process, right before it executes the container command.
+func (c *Container) setProcessLimits() error {
+	if err := c.setRlimits(); err != nil {
+		return errors.Wrap(err, "unable to set container's ulimits")
+	}
+	if err := c.setOomScoreAdj(); err != nil {
+		return errors.Wrap(err, "unable to set container's OOM score adjustment")
+	}
+	return nil
+}
+
+// commandArgs returns the command to run: the image's Cmd is used when
+// cmdArgs is empty, and the image's Entrypoint is prepended.
+func (c *Container) commandArgs(cmdArgs []string) []string {
+	if len(cmdArgs) < 1 {
+		cmdArgs = append(cmdArgs, c.Config.Cmd...)
+	}
+
+	if len(c.Config.Entrypoint) > 0 {
+		cmdArgs = append(c.Config.Entrypoint, cmdArgs...)
+	}
+	return cmdArgs
+}
+
+// LoadConfig reads container config and host config files
 func (c *Container) LoadConfig() error {
+	if err := c.loadImageConfig(); err != nil {
+		return err
+	}
+	return c.loadHostConfig()
+}
+
+// loadImageConfig reads container config file, the image's one
+func (c *Container) loadImageConfig() error {
 	c.log.Debug().Msg("Load container config from file")
 	conCfg := filepath.Join(constants.KokerContainersPath, c.ID, "config.json")
 
@@ -308,42 +756,65 @@ func (c *Container) getCmd() (string, error) {
 	return cmd, nil
 }
 
-// copyNameServerConfig copies name resolver configurations
-func (c *Container) copyNameServerConfig() error {
-	c.log.Info().Msg("Copy nameserver config")
-	resolvFilePaths := []string{
-		fmt.Sprintf("/etc/%sresolv.conf", constants.KokerApp),
-		"/etc/resolv.conf",
-		"/var/run/systemd/resolve/resolv.conf",
-	}
-	for _, resolvFilePath := range resolvFilePaths {
-		if _, err := os.Stat(resolvFilePath); os.IsNotExist(err) {
-			continue
-		}
-		if err := utils.CopyFile(resolvFilePath,
-			filepath.Join(c.RootFS, "etc/resolv.conf")); err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
 // setLimit configures resource limit using cgroup
-func (c *Container) setLimit(mem, swap, pids int, cpus float64) error {
+func (c *Container) setLimit(hc *HostConfig) error {
 	c.log.Info().Msg("Set container's limit using cgroup")
 	c.log.Debug().Msg("Set container's memory limit")
-	if err := c.cg.SetMemSwpLimit(mem, swap); err != nil {
+	if err := c.cg.SetMemSwpLimit(int64(hc.Memory), int64(hc.Swap)); err != nil {
+		return err
+	}
+	if err := c.cg.SetMemoryReservation(int64(hc.MemoryReservation)); err != nil {
+		return err
+	}
+	if err := c.cg.SetMemoryHigh(int64(hc.MemoryHigh)); err != nil {
+		return err
+	}
+	swappiness := -1
+	if hc.MemorySwappiness != nil {
+		swappiness = *hc.MemorySwappiness
+	}
+	if err := c.cg.SetMemorySwappiness(swappiness); err != nil {
+		return err
+	}
+	if err := c.cg.SetOOMKillDisable(hc.OOMKillDisable); err != nil {
 		return err
 	}
 	c.log.Debug().Msg("Set container's pids limit")
-	if err := c.cg.SetPidsLimit(pids); err != nil {
+	if err := c.cg.SetPidsLimit(hc.Pids); err != nil {
 		return err
 	}
 	c.log.Debug().Msg("Set container's cpus limit")
-	if err := c.cg.SetCPULimit(cpus); err != nil {
+	if hc.CPUQuota != 0 || hc.CPUPeriod != 0 {
+		if err := c.cg.SetCPUQuota(hc.CPUQuota, hc.CPUPeriod); err != nil {
+			return err
+		}
+	} else if err := c.cg.SetCPULimit(hc.CPUs); err != nil {
 		return err
 	}
-	return nil
+	c.log.Debug().Msg("Set container's cpu weight")
+	if hc.CPUWeight != 0 {
+		if err := c.cg.SetCPUWeight(hc.CPUWeight); err != nil {
+			return err
+		}
+	} else if err := c.cg.SetCPUShares(hc.CPUShares); err != nil {
+		return err
+	}
+	c.log.Debug().Msg("Set container's cpuset")
+	if err := c.cg.SetCpusetCPUs(hc.CpusetCPUs); err != nil {
+		return err
+	}
+	if err := c.cg.SetCpusetMems(hc.CpusetMems); err != nil {
+		return err
+	}
+	c.log.Debug().Msg("Set container's block I/O limits")
+	if err := c.cg.SetBlkioWeight(hc.BlkioWeight); err != nil {
+		return err
+	}
+	throttle, err := hc.blkioThrottle()
+	if err != nil {
+		return err
+	}
+	return c.cg.SetBlkioThrottle(throttle)
 }
 
 // setHostname sets container's hostname
@@ -360,11 +831,42 @@ func (c *Container) setHostname(hostname string) {
 func (c *Container) delete() error {
 	c.log.Info().Msg("Delete container")
 	c.log.Debug().Msg("Remove container's directory")
-	if err := os.RemoveAll(filepath.Join(constants.KokerContainersPath, c.ID)); err != nil {
+	if err := RemoveDir(c.ID); err != nil {
 		return errors.Wrap(err, "unable to remove container's directory")
 	}
+	return c.cleanup()
+}
+
+// RemoveDir removes the directory of container id. Rootless containers
+// write files owned by subordinate ids in their upper directory, which
+// the user can't remove: the directory is removed as root in a user
+// namespace with the same mappings, by `container remove-dir`.
+func RemoveDir(id string) error {
+	if id == "" || strings.ContainsRune(id, '/') {
+		return errors.Errorf("invalid container id %q", id)
+	}
+	dir := filepath.Join(constants.KokerContainersPath, id)
+	if os.Geteuid() == 0 {
+		return os.RemoveAll(dir)
+	}
+
+	var stderr bytes.Buffer
+	cmd := reexec.Command("-q", "container", "remove-dir", id)
+	cmd.Stderr = &stderr
+	if err := userns.Start(cmd); err != nil {
+		return errors.Wrap(err, "unable to start in a user namespace")
+	}
+	if err := cmd.Wait(); err != nil {
+		return errors.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// cleanup removes what a container only needs while running: its
+// network namespace and cgroups
+func (c *Container) cleanup() error {
 	c.log.Debug().Msg("Remove container's network namespace")
-	if err := os.RemoveAll(filepath.Join(constants.KokerNetNsPath, c.ID)); err != nil {
+	if err := os.RemoveAll(c.netnsPath()); err != nil {
 		return errors.Wrap(err, "unable to remove network namespace")
 	}
 	c.log.Debug().Msg("Remove container cgroups")
@@ -372,26 +874,63 @@ func (c *Container) delete() error {
 	return nil
 }
 
-// mountOverlayFS mounts filesystem for Container from an Image.
+// netnsPath returns where the container's network namespace is mounted
+func (c *Container) netnsPath() string {
+	return filepath.Join(constants.KokerNetNsPath, c.ID)
+}
+
+// mountOverlayFS mounts filesystem for Container from layers.
 // It uses overlayFS for union mount of multiple layers.
-func (c *Container) mountOverlayFS(img *images.Image) (filesystem.Unmounter, error) {
-	c.log.Info().Str("image", img.Metadata.Name).
-		Msg("Mount filesystem for container from an image")
+func (c *Container) mountOverlayFS(layers []string) (filesystem.Unmounter, error) {
+	c.log.Info().Strs("layers", layers).Bool("ro", c.HostConfig.ReadOnly).
+		Msg("Mount filesystem for container")
+	return filesystem.OverlayMount(c.RootFS, layers, c.HostConfig.ReadOnly)
+}
+
+// mountRootFS mounts filesystem for a rootless Container from layers.
+// Overlayfs can be mounted in a user namespace since Linux 5.11, older
+// kernels fall back to a plain copy of the layers.
+func (c *Container) mountRootFS(layers []string) (filesystem.Unmounter, error) {
+	ro := c.HostConfig.ReadOnly
+	c.log.Info().Strs("layers", layers).Bool("ro", ro).
+		Msg("Mount filesystem for rootless container")
+	unmounter, err := filesystem.OverlayMount(c.RootFS, layers, ro)
+	if err == nil {
+		return unmounter, nil
+	}
+	c.log.Warn().Err(err).Msg("Unable to mount overlayfs, fall back to copying layers")
+	removeCopy, err := filesystem.CopyMount(c.RootFS, layers)
+	if err != nil || !ro {
+		return removeCopy, err
+	}
+
+	// Make the copy read-only
+	unmountRO, err := filesystem.BindMount(c.RootFS, c.RootFS, true)
+	return func() error {
+		if err := unmountRO(); err != nil {
+			return err
+		}
+		return removeCopy()
+	}, err
+}
+
+// prepareDir creates the container's root filesystem directory
+func (c *Container) prepareDir() error {
 	if err := os.MkdirAll(c.RootFS, 0700); err != nil {
-		return nil, errors.Wrapf(err, "can't create %s directory", c.RootFS)
+		return errors.Wrapf(err, "can't create %s directory", c.RootFS)
 	}
+	return nil
+}
 
+// imageLayers returns the extracted layer directories of an Image,
+// topmost first as overlayfs expects its lowerdirs.
+func (c *Container) imageLayers(img *images.Image) []string {
 	imgLayers := img.Metadata.Manifest.Layers
 	layers := make([]string, 0)
-	for _, i := range imgLayers {
-		layers = append(layers, filepath.Join(constants.KokerImagesPath, img.Metadata.Digest, i.Digest.Hex))
+	for i := len(imgLayers) - 1; i >= 0; i-- {
+		layers = append(layers, filepath.Join(constants.KokerImagesPath, img.Metadata.Digest, imgLayers[i].Digest.Hex))
 	}
-	unmounter, err := filesystem.OverlayMount(c.RootFS, layers, false)
-	if err != nil {
-		return unmounter, err
-	}
-
-	return unmounter, c.copyImageConfig(img)
+	return layers
 }
 
 func (c *Container) copyImageConfig(img *images.Image) error {
@@ -401,11 +940,29 @@ func (c *Container) copyImageConfig(img *images.Image) error {
 	return utils.CopyFile(imgCfg, conCfg)
 }
 
+// setupBridge creates the default bridge if needed, and the iptables
+// rules for its outgoing traffic
+func setupBridge() error {
+	if ok, _ := network.CheckBridgeUp(constants.KokerBridgeName); !ok {
+		if err := network.SetupBridge(constants.KokerBridgeName,
+			constants.KokerBridgeDefaultIP+"/16"); err != nil {
+			return errors.Wrap(err, "unable to create default bridge")
+		}
+	}
+
+	// Setup iptables rules for outgoing traffic
+	if err := network.AppendPOSTROUTINGRule(constants.KokerBridgeIPCIDR,
+		constants.KokerBridgeName); err != nil {
+		return errors.Wrap(err, "unable to setup iptables rules")
+	}
+	return nil
+}
+
 // setupNetwork configures network for the container
 func (c *Container) setupNetwork(bridge string) (filesystem.Unmounter, error) {
 	c.log.Info().Msg("Setup network for container")
-	nsMountTarget := filepath.Join(constants.KokerNetNsPath, c.ID)
-	vethName := fmt.Sprintf("%s%.7s", constants.KokerVirtual0Pfx, c.ID)
+	nsMountTarget := c.netnsPath()
+	vethName := c.vethName()
 	peerName := fmt.Sprintf("%s%.7s", constants.KokerVirtual1Pfx, c.ID)
 
 	if err := network.SetupVirtualEthernet(vethName, peerName); err != nil {
@@ -437,6 +994,7 @@ func (c *Container) setupNetwork(bridge string) (filesystem.Unmounter, error) {
 	}()
 
 	ctrEthIPAddr := utils.GenIPAddress()
+	c.ipAddress, _, _ = strings.Cut(ctrEthIPAddr, "/")
 	if err := network.LinkRename(peerName, constants.KokerCtrEthName); err != nil {
 		return unmount, err
 	}
@@ -446,6 +1004,9 @@ func (c *Container) setupNetwork(bridge string) (filesystem.Unmounter, error) {
 	if err := network.LinkSetup(constants.KokerCtrEthName); err != nil {
 		return unmount, err
 	}
+	if c.macAddress, err = network.LinkHardwareAddr(constants.KokerCtrEthName); err != nil {
+		return unmount, err
+	}
 	if err := network.LinkAddGateway(constants.KokerCtrEthName, constants.KokerBridgeDefaultIP); err != nil {
 		return unmount, err
 	}
@@ -456,9 +1017,13 @@ func (c *Container) setupNetwork(bridge string) (filesystem.Unmounter, error) {
 	return unmount, nil
 }
 
+// vethName returns the name of the host end of the container's veth pair
+func (c *Container) vethName() string {
+	return fmt.Sprintf("%s%.7s", constants.KokerVirtual0Pfx, c.ID)
+}
+
 // setNetworkNamespace
 func (c *Container) setNetworkNamespace() (network.Unsetter, error) {
 	c.log.Debug().Msg("Set network namespace")
-	netns := filepath.Join(constants.KokerNetNsPath, c.ID)
-	return network.SetNetNSByFile(netns)
+	return network.SetNetNSByFile(c.netnsPath())
 }
@@ -0,0 +1,272 @@
+package containers
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+
+	"github.com/ntk148v/koker/pkg/cgroups"
+	"github.com/ntk148v/koker/pkg/filesystem"
+	"github.com/ntk148v/koker/pkg/userns"
+	"github.com/ntk148v/koker/pkg/utils"
+)
+
+// Device is a host device available in the container
+type Device struct {
+	PathOnHost      string `json:"path_on_host"`
+	PathInContainer string `json:"path_in_container"`
+	// CgroupPermissions is a combination of r, w and m
+	CgroupPermissions string `json:"cgroup_permissions"`
+}
+
+// defaultDevices are created in every container's /dev
+var defaultDevices = []string{"/dev/null", "/dev/zero", "/dev/full",
+	"/dev/random", "/dev/urandom", "/dev/tty"}
+
+// defaultDeviceRules allow the default devices, ptmx and ptys,
+// and creating any device node.
+var defaultDeviceRules = []cgroups.DeviceRule{
+	{Type: 'c', Major: -1, Minor: -1, Access: "m", Allow: true},
+	{Type: 'b', Major: -1, Minor: -1, Access: "m", Allow: true},
+	{Type: 'c', Major: 1, Minor: 3, Access: "rwm", Allow: true},    // null
+	{Type: 'c', Major: 1, Minor: 5, Access: "rwm", Allow: true},    // zero
+	{Type: 'c', Major: 1, Minor: 7, Access: "rwm", Allow: true},    // full
+	{Type: 'c', Major: 1, Minor: 8, Access: "rwm", Allow: true},    // random
+	{Type: 'c', Major: 1, Minor: 9, Access: "rwm", Allow: true},    // urandom
+	{Type: 'c', Major: 5, Minor: 0, Access: "rwm", Allow: true},    // tty
+	{Type: 'c', Major: 5, Minor: 2, Access: "rwm", Allow: true},    // ptmx
+	{Type: 'c', Major: 136, Minor: -1, Access: "rwm", Allow: true}, // pts
+}
+
+// devLinks are the symlinks of the container's /dev
+var devLinks = map[string]string{
+	"fd":     "/proc/self/fd",
+	"stdin":  "/proc/self/fd/0",
+	"stdout": "/proc/self/fd/1",
+	"stderr": "/proc/self/fd/2",
+}
+
+// devicePermissionsRe matches device cgroup permissions
+var devicePermissionsRe = regexp.MustCompile(`^[rwm]{1,3}$`)
+
+// ParseDevice parses a device in host[:container][:permissions] format,
+// the device is available at the same path by default, with rwm
+// permissions.
+func ParseDevice(s string) (Device, error) {
+	parts := strings.Split(s, ":")
+	d := Device{PathOnHost: parts[0], CgroupPermissions: "rwm"}
+	switch len(parts) {
+	case 1:
+	case 2:
+		if devicePermissionsRe.MatchString(parts[1]) {
+			d.CgroupPermissions = parts[1]
+		} else {
+			d.PathInContainer = parts[1]
+		}
+	case 3:
+		d.PathInContainer, d.CgroupPermissions = parts[1], parts[2]
+	default:
+		return d, errors.Errorf("invalid device %q, expected host[:container][:permissions]", s)
+	}
+	if d.PathInContainer == "" {
+		d.PathInContainer = d.PathOnHost
+	}
+
+	if !path.IsAbs(d.PathOnHost) || !path.IsAbs(d.PathInContainer) {
+		return d, errors.Errorf("invalid device %q, paths must be absolute", s)
+	}
+	d.PathInContainer = path.Clean(d.PathInContainer)
+	if !strings.HasPrefix(d.PathInContainer, "/dev/") {
+		return d, errors.Errorf("invalid device %q, container path must be in /dev", s)
+	}
+	if !devicePermissionsRe.MatchString(d.CgroupPermissions) {
+		return d, errors.Errorf("invalid device %q, permissions must be a combination of r, w and m", s)
+	}
+	if _, err := deviceRule(d.PathOnHost, d.CgroupPermissions); err != nil {
+		return d, err
+	}
+	return d, nil
+}
+
+// ParseDevices parses a list of devices
+func ParseDevices(ss []string) ([]Device, error) {
+	var devices []Device
+	for _, s := range ss {
+		d, err := ParseDevice(s)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, d)
+	}
+	return devices, nil
+}
+
+// validateDeviceCgroupRules checks the --device-cgroup-rule rules
+func (hc *HostConfig) validateDeviceCgroupRules() error {
+	for _, r := range hc.DeviceCgroupRules {
+		if _, err := cgroups.ParseDeviceRule(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deviceRule returns the rule allowing access to a host device
+func deviceRule(hostPath, access string) (cgroups.DeviceRule, error) {
+	rule := cgroups.DeviceRule{Access: access, Allow: true}
+	var st unix.Stat_t
+	if err := unix.Stat(hostPath, &st); err != nil {
+		return rule, errors.Wrapf(err, "unable to stat device %s", hostPath)
+	}
+	switch st.Mode & unix.S_IFMT {
+	case unix.S_IFCHR:
+		rule.Type = 'c'
+	case unix.S_IFBLK:
+		rule.Type = 'b'
+	default:
+		return rule, errors.Errorf("%s is not a device", hostPath)
+	}
+	rule.Major, rule.Minor = int64(unix.Major(st.Rdev)), int64(unix.Minor(st.Rdev))
+	return rule, nil
+}
+
+// deviceRules returns the device cgroup rules of the container
+func (c *Container) deviceRules() ([]cgroups.DeviceRule, error) {
+	hc := c.HostConfig
+	if hc.Privileged {
+		return []cgroups.DeviceRule{cgroups.AllowAllDevices}, nil
+	}
+
+	rules := append([]cgroups.DeviceRule{}, defaultDeviceRules...)
+	for _, d := range hc.Devices {
+		rule, err := deviceRule(d.PathOnHost, d.CgroupPermissions)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	for _, r := range hc.DeviceCgroupRules {
+		rule, err := cgroups.ParseDeviceRule(r)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// setDeviceRules restricts the container's device access. A rootless
+// container can't use the device controller, nor access more devices
+// than its user.
+func (c *Container) setDeviceRules() error {
+	if userns.Rootless() {
+		if len(c.HostConfig.DeviceCgroupRules) > 0 {
+			c.log.Warn().Msg("Rootless mode, device cgroup rules are ignored")
+		}
+		return nil
+	}
+	rules, err := c.deviceRules()
+	if err != nil {
+		return err
+	}
+	c.log.Debug().Int("rules", len(rules)).Msg("Set container's device rules")
+	return c.cg.SetDeviceRules(rules)
+}
+
+// mountDev mounts the container's /dev: a tmpfs with the default and
+// --device devices, or the host's /dev for privileged containers.
+func (c *Container) mountDev() (filesystem.Unmounter, error) {
+	if c.HostConfig.Privileged {
+		if len(c.HostConfig.Devices) > 0 {
+			c.log.Info().Msg("Privileged container has all host devices, skip --device")
+		}
+		return c.mountHostDev()
+	}
+
+	c.log.Info().Msg("Create container's devices")
+	dev := filepath.Join(c.RootFS, "dev")
+	var unmounters []filesystem.Unmounter
+	unmounter := func() error {
+		for i := len(unmounters) - 1; i >= 0; i-- {
+			if err := unmounters[i](); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	unmount, err := filesystem.Mount(filesystem.MountOption{
+		Source: "tmpfs", Target: dev, Type: "tmpfs",
+		Flag: unix.MS_NOSUID | unix.MS_STRICTATIME, Option: "mode=755",
+	})
+	if err != nil {
+		return unmount, err
+	}
+	unmounters = append(unmounters, unmount)
+
+	devices := make(map[string]string)
+	for _, d := range defaultDevices {
+		devices[d] = d
+	}
+	for _, d := range c.HostConfig.Devices {
+		devices[d.PathInContainer] = d.PathOnHost
+	}
+	for containerPath, hostPath := range devices {
+		target := filepath.Join(c.RootFS, containerPath)
+		unmount, err := c.createDevice(hostPath, target)
+		if err != nil {
+			return unmounter, errors.Wrapf(err, "unable to create device %s", containerPath)
+		}
+		if unmount != nil {
+			unmounters = append(unmounters, unmount)
+		}
+	}
+
+	for name, link := range devLinks {
+		if err := os.Symlink(link, filepath.Join(dev, name)); err != nil {
+			return unmounter, err
+		}
+	}
+	return unmounter, nil
+}
+
+// createDevice creates a node of a host device. Device nodes can't be
+// created in a user namespace: the host device is bind mounted instead,
+// the returned unmounter is nil otherwise.
+func (c *Container) createDevice(hostPath, target string) (filesystem.Unmounter, error) {
+	if err := utils.CreateDir(filepath.Dir(target)); err != nil {
+		return nil, err
+	}
+	if userns.Rootless() {
+		if err := os.WriteFile(target, nil, 0644); err != nil {
+			return nil, err
+		}
+		return filesystem.BindMount(hostPath, target, false)
+	}
+
+	var st unix.Stat_t
+	if err := unix.Stat(hostPath, &st); err != nil {
+		return nil, err
+	}
+	if err := unix.Mknod(target, st.Mode, int(st.Rdev)); err != nil {
+		return nil, err
+	}
+	// Mknod permissions are masked by the umask
+	return nil, os.Chmod(target, os.FileMode(st.Mode&0777))
+}
+
+// mountHostDev bind mounts the host's /dev, with all its devices,
+// to the container's /dev. It is only done for privileged containers.
+func (c *Container) mountHostDev() (filesystem.Unmounter, error) {
+	c.log.Info().Msg("Mount host devices")
+	target := filepath.Join(c.RootFS, "dev")
+	if err := utils.CreateDir(target); err != nil {
+		return nil, err
+	}
+	return filesystem.BindMount("/dev", target, false)
+}
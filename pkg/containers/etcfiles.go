@@ -0,0 +1,212 @@
+package containers
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/ntk148v/koker/pkg/constants"
+	"github.com/ntk148v/koker/pkg/filesystem"
+)
+
+// etcFiles are generated in the container's directory
+// and bind mounted to the container's /etc
+var etcFiles = []string{"hosts", "hostname", "resolv.conf"}
+
+// defaultNameServers are used when the host has none
+// reachable from the container
+var defaultNameServers = []string{"8.8.8.8", "8.8.4.4"}
+
+// defaultHosts are the localhost entries of /etc/hosts
+const defaultHosts = `127.0.0.1	localhost
+::1	localhost ip6-localhost ip6-loopback
+fe00::0	ip6-localnet
+ff00::0	ip6-mcastprefix
+ff02::1	ip6-allnodes
+ff02::2	ip6-allrouters
+`
+
+// ValidateDNS checks nameserver addresses
+func ValidateDNS(dns []string) error {
+	for _, ns := range dns {
+		if net.ParseIP(ns) == nil {
+			return errors.Errorf("invalid nameserver %q", ns)
+		}
+	}
+	return nil
+}
+
+// ValidateExtraHosts checks extra hosts in host:ip format
+func ValidateExtraHosts(extraHosts []string) error {
+	for _, h := range extraHosts {
+		// Split at the first colon, the IP may be an IPv6 one
+		host, ip, ok := strings.Cut(h, ":")
+		if !ok || host == "" || net.ParseIP(ip) == nil {
+			return errors.Errorf("invalid extra host %q, expected host:ip", h)
+		}
+	}
+	return nil
+}
+
+// generateEtcFiles writes the container's hosts, hostname and resolv.conf
+// to its directory. ip is the container address, if it has one.
+func (c *Container) generateEtcFiles(ip string) error {
+	c.log.Info().Msg("Generate hosts, hostname and resolv.conf")
+	dir := filepath.Join(constants.KokerContainersPath, c.ID)
+	hc := c.HostConfig
+
+	var hosts strings.Builder
+	hosts.WriteString(defaultHosts)
+	if ip != "" {
+		fmt.Fprintf(&hosts, "%s\t%s\n", ip, hc.Hostname)
+	}
+	for _, h := range hc.ExtraHosts {
+		host, ip, _ := strings.Cut(h, ":")
+		fmt.Fprintf(&hosts, "%s\t%s\n", ip, host)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "hosts"), []byte(hosts.String()), 0644); err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "hostname"), []byte(hc.Hostname+"\n"), 0644); err != nil {
+		return err
+	}
+
+	resolvConf, err := c.resolvConf()
+	if err != nil {
+		return errors.Wrap(err, "unable to generate resolv.conf")
+	}
+	return os.WriteFile(filepath.Join(dir, "resolv.conf"), []byte(resolvConf), 0644)
+}
+
+// resolvConf returns the container's resolv.conf: the host's nameservers,
+// search domains and options, overridden by --dns, --dns-search and
+// --dns-option.
+func (c *Container) resolvConf() (string, error) {
+	hc := c.HostConfig
+	nameServers, search, options, err := hostResolvConf(hc.privateNetwork())
+	if err != nil {
+		return "", err
+	}
+	if len(hc.DNS) > 0 {
+		nameServers = hc.DNS
+	} else if len(nameServers) == 0 {
+		c.log.Debug().Strs("nameservers", defaultNameServers).
+			Msg("No usable nameserver on the host, use default ones")
+		nameServers = defaultNameServers
+	}
+	if len(hc.DNSSearch) > 0 {
+		search = hc.DNSSearch
+	}
+	if len(hc.DNSOptions) > 0 {
+		options = hc.DNSOptions
+	}
+
+	var b strings.Builder
+	for _, ns := range nameServers {
+		fmt.Fprintf(&b, "nameserver %s\n", ns)
+	}
+	if len(search) > 0 {
+		fmt.Fprintf(&b, "search %s\n", strings.Join(search, " "))
+	}
+	if len(options) > 0 {
+		fmt.Fprintf(&b, "options %s\n", strings.Join(options, " "))
+	}
+	return b.String(), nil
+}
+
+// hostResolvConf parses the first host's resolv.conf candidate. With a
+// private network, the loopback nameservers, such as systemd-resolved's
+// 127.0.0.53 stub, are filtered out as they aren't reachable from the
+// container's network namespace. systemd-resolved's upstream
+// configuration is used instead when the stub is the only nameserver.
+func hostResolvConf(privateNetwork bool) (nameServers, search, options []string, err error) {
+	resolvFilePaths := []string{
+		fmt.Sprintf("/etc/%sresolv.conf", constants.KokerApp),
+		"/etc/resolv.conf",
+		"/run/systemd/resolve/resolv.conf",
+	}
+	for _, resolvFilePath := range resolvFilePaths {
+		f, err := os.Open(resolvFilePath)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, nil, nil, err
+		}
+
+		nameServers, search, options = nil, nil, nil
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 2 {
+				continue
+			}
+			switch fields[0] {
+			case "nameserver":
+				if ip := net.ParseIP(fields[1]); ip != nil && !(privateNetwork && ip.IsLoopback()) {
+					nameServers = append(nameServers, fields[1])
+				}
+			case "search", "domain":
+				search = fields[1:]
+			case "options":
+				options = append(options, fields[1:]...)
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if len(nameServers) > 0 {
+			break
+		}
+	}
+	return nameServers, search, options, nil
+}
+
+// mountEtcFiles bind mounts the generated hosts, hostname and resolv.conf
+// to the container's /etc. The target files are created if needed, unless
+// the root filesystem is read-only.
+func (c *Container) mountEtcFiles() (filesystem.Unmounter, error) {
+	c.log.Info().Msg("Mount hosts, hostname and resolv.conf")
+	var unmounters []filesystem.Unmounter
+	unmounter := func() error {
+		for i := len(unmounters) - 1; i >= 0; i-- {
+			if err := unmounters[i](); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, name := range etcFiles {
+		source := filepath.Join(constants.KokerContainersPath, c.ID, name)
+		target := filepath.Join(c.RootFS, "etc", name)
+		if info, err := os.Lstat(target); err != nil || info.Mode()&os.ModeSymlink != 0 {
+			if c.HostConfig.ReadOnly {
+				c.log.Warn().Str("file", "/etc/"+name).
+					Msg("File missing in read-only root filesystem, skip it")
+				continue
+			}
+			// A symlink may point outside of the root filesystem
+			os.Remove(target)
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return unmounter, err
+			}
+			if err := os.WriteFile(target, nil, 0644); err != nil {
+				return unmounter, err
+			}
+		}
+		unmount, err := filesystem.BindMount(source, target, false)
+		if err != nil {
+			return unmounter, err
+		}
+		unmounters = append(unmounters, unmount)
+	}
+	return unmounter, nil
+}
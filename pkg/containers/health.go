@@ -0,0 +1,261 @@
+package containers
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"syscall"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/pkg/errors"
+
+	"github.com/ntk148v/koker/pkg/reexec"
+)
+
+// Health statuses of a container with a health check
+const (
+	HealthStarting  = "starting"
+	HealthHealthy   = "healthy"
+	HealthUnhealthy = "unhealthy"
+)
+
+// Health check defaults, when neither the image nor the options set them
+const (
+	defaultHealthInterval = 30 * time.Second
+	defaultHealthTimeout  = 30 * time.Second
+	defaultHealthRetries  = 3
+)
+
+// healthLogSize is the number of health check results kept
+const healthLogSize = 5
+
+// healthOutputLimit is the size of the output kept per health check
+const healthOutputLimit = 4096
+
+// Health is the health status of a container, with its last checks
+type Health struct {
+	Status        string         `json:"status"`
+	FailingStreak int            `json:"failing_streak"`
+	Log           []HealthResult `json:"log"`
+}
+
+// HealthResult is the result of a health check
+type HealthResult struct {
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	ExitCode int       `json:"exit_code"`
+	Output   string    `json:"output"`
+}
+
+// NewHealthConfig returns the health check of --health-cmd, an empty
+// command keeps the image's one
+func NewHealthConfig(cmd string, interval, timeout, startPeriod time.Duration, retries int) *v1.HealthConfig {
+	health := &v1.HealthConfig{
+		Interval:    interval,
+		Timeout:     timeout,
+		StartPeriod: startPeriod,
+		Retries:     retries,
+	}
+	if cmd != "" {
+		health.Test = []string{"CMD-SHELL", cmd}
+	}
+	return health
+}
+
+// validateHealthcheck checks the health check options
+func (hc *HostConfig) validateHealthcheck() error {
+	health := hc.Healthcheck
+	if health == nil {
+		return nil
+	}
+	if hc.NoHealthcheck && len(health.Test) > 0 {
+		return errors.New("--no-healthcheck conflicts with --health-cmd")
+	}
+	if health.Interval < 0 || health.Timeout < 0 || health.StartPeriod < 0 {
+		return errors.New("health check durations can't be negative")
+	}
+	if health.Retries < 0 {
+		return errors.New("health check retries can't be negative")
+	}
+	return nil
+}
+
+// healthConfig returns the container's health check: the image's one with
+// the --health-* options, nil if there is none or it is disabled
+func (c *Container) healthConfig() *v1.HealthConfig {
+	if c.HostConfig.NoHealthcheck {
+		return nil
+	}
+	var health v1.HealthConfig
+	if c.Config.Healthcheck != nil {
+		health = *c.Config.Healthcheck
+	}
+	if o := c.HostConfig.Healthcheck; o != nil {
+		if len(o.Test) > 0 {
+			health.Test = o.Test
+		}
+		if o.Interval > 0 {
+			health.Interval = o.Interval
+		}
+		if o.Timeout > 0 {
+			health.Timeout = o.Timeout
+		}
+		if o.StartPeriod > 0 {
+			health.StartPeriod = o.StartPeriod
+		}
+		if o.Retries > 0 {
+			health.Retries = o.Retries
+		}
+	}
+	if len(health.Test) == 0 || health.Test[0] == "NONE" {
+		return nil
+	}
+
+	if health.Interval == 0 {
+		health.Interval = defaultHealthInterval
+	}
+	if health.Timeout == 0 {
+		health.Timeout = defaultHealthTimeout
+	}
+	if health.Retries == 0 {
+		health.Retries = defaultHealthRetries
+	}
+	return &health
+}
+
+// healthTestArgs returns the command of a health test
+func healthTestArgs(test []string) ([]string, error) {
+	if len(test) < 2 {
+		return nil, errors.Errorf("invalid health check test %q", test)
+	}
+	switch test[0] {
+	case "CMD":
+		return test[1:], nil
+	case "CMD-SHELL":
+		return []string{"/bin/sh", "-c", strings.Join(test[1:], " ")}, nil
+	default:
+		return nil, errors.Errorf("unknown health check test type %q", test[0])
+	}
+}
+
+// ExecuteHealthcheck runs the container's health test inside it
+func (c *Container) ExecuteHealthcheck() error {
+	health := c.healthConfig()
+	if health == nil {
+		return errors.New("container has no health check")
+	}
+	args, err := healthTestArgs(health.Test)
+	if err != nil {
+		return err
+	}
+	// The test is the whole command, the entrypoint doesn't apply
+	c.Config.Entrypoint = nil
+	return c.ExecuteCommand(args, false)
+}
+
+// monitorHealth runs the health check on its interval until stop is
+// closed, the results are recorded in the container's state.
+func (c *Container) monitorHealth(health *v1.HealthConfig, stop <-chan struct{}) {
+	c.log.Info().Strs("test", health.Test).Dur("interval", health.Interval).
+		Msg("Monitor container's health")
+	started := time.Now()
+	c.updateState(func(s *State) {
+		s.Health = &Health{Status: HealthStarting}
+	})
+
+	ticker := time.NewTicker(health.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		// The check can't run until the container is unpaused
+		if c.paused() {
+			continue
+		}
+
+		result, ok := c.runHealthcheck(health.Timeout, stop)
+		if !ok {
+			return
+		}
+		// Failures don't count while the container is starting
+		starting := time.Since(started) < health.StartPeriod
+		c.updateState(func(s *State) {
+			s.Health.record(result, health.Retries, starting)
+			c.log.Debug().Int("exit_code", result.ExitCode).Str("status", s.Health.Status).
+				Msg("Container health checked")
+		})
+	}
+}
+
+// record adds a health check result to the log and updates the status
+func (h *Health) record(result HealthResult, retries int, starting bool) {
+	h.Log = append(h.Log, result)
+	if len(h.Log) > healthLogSize {
+		h.Log = h.Log[len(h.Log)-healthLogSize:]
+	}
+
+	if result.ExitCode == 0 {
+		h.Status, h.FailingStreak = HealthHealthy, 0
+		return
+	}
+	if starting && h.Status == HealthStarting {
+		return
+	}
+	h.FailingStreak++
+	if h.FailingStreak >= retries {
+		h.Status = HealthUnhealthy
+	}
+}
+
+// runHealthcheck runs the health check with `container healthcheck`,
+// which is killed with the test when it exceeds timeout. The check is
+// interrupted when stop is closed, it then has no result.
+func (c *Container) runHealthcheck(timeout time.Duration, stop <-chan struct{}) (HealthResult, bool) {
+	result := HealthResult{Start: time.Now(), ExitCode: -1}
+	var output bytes.Buffer
+	cmd := reexec.Command("-q", "container", "healthcheck", c.ID)
+	cmd.Stdout, cmd.Stderr = &output, &output
+	// The test runs in the group of the check, so that both can be killed
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	if err := cmd.Start(); err != nil {
+		result.End, result.Output = time.Now(), err.Error()
+		return result, true
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		result.ExitCode = cmd.ProcessState.ExitCode()
+		result.Output = output.String()
+	case <-timer.C:
+		killProcessGroup(cmd.Process.Pid, done)
+		result.Output = fmt.Sprintf("Health check exceeded timeout (%s)", timeout)
+	case <-stop:
+		killProcessGroup(cmd.Process.Pid, done)
+		return result, false
+	}
+	result.End = time.Now()
+	if len(result.Output) > healthOutputLimit {
+		result.Output = result.Output[:healthOutputLimit]
+	}
+	return result, true
+}
+
+// killProcessGroup kills a process group and waits for its leader,
+// whose Wait result is sent to done. Its other processes may still
+// use the container's root filesystem, they are given a second to exit.
+func killProcessGroup(pgid int, done <-chan error) {
+	syscall.Kill(-pgid, syscall.SIGKILL)
+	<-done
+	for i := 0; i < 100 && syscall.Kill(-pgid, 0) == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,160 @@
+package containers
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/pkg/errors"
+
+	"github.com/ntk148v/koker/pkg/cgroups"
+	"github.com/ntk148v/koker/pkg/constants"
+	"github.com/ntk148v/koker/pkg/landlock"
+)
+
+// HostConfig holds the options a container is run with, as opposed to
+// Config which comes from the image. It is stored in the container's
+// directory, that's how the child process gets it.
+type HostConfig struct {
+	Image      string   `json:"image"`
+	RootFSPath string   `json:"rootfs_path,omitempty"`
+	RootFSTar  string   `json:"rootfs_tar,omitempty"`
+	Cmd        []string `json:"cmd,omitempty"`
+	ReadOnly   bool     `json:"read_only"`
+	Privileged bool     `json:"privileged"`
+	Hostname   string   `json:"hostname"`
+	// Memory and swap on top of it, in bytes. Swap is 0 for none and
+	// Unlimited for no limit, as without memory limit.
+	Memory Bytes `json:"memory"`
+	Swap   Bytes `json:"swap"`
+	// Memory soft limit, throttling limit of cgroups v2, swappiness
+	// and OOM killer of cgroups v1
+	MemoryReservation Bytes   `json:"memory_reservation,omitempty"`
+	MemoryHigh        Bytes   `json:"memory_high,omitempty"`
+	MemorySwappiness  *int    `json:"memory_swappiness,omitempty"`
+	OOMKillDisable    bool    `json:"oom_kill_disable,omitempty"`
+	Pids              int     `json:"pids"`
+	CPUs              float64 `json:"cpus"`
+	CpusetCPUs        string  `json:"cpuset_cpus,omitempty"`
+	CpusetMems        string  `json:"cpuset_mems,omitempty"`
+	// Relative CPU weight, as cgroup v1 shares or a cgroup v2 weight
+	CPUShares uint64 `json:"cpu_shares,omitempty"`
+	CPUWeight uint64 `json:"cpu_weight,omitempty"`
+	// CFS period and quota in microseconds, exclusive with CPUs
+	CPUPeriod int64 `json:"cpu_period,omitempty"`
+	CPUQuota  int64 `json:"cpu_quota,omitempty"`
+	// Relative block I/O weight and rate limits of host block devices
+	BlkioWeight     uint16            `json:"blkio_weight,omitempty"`
+	DeviceReadBps   []ThrottleDevice  `json:"device_read_bps,omitempty"`
+	DeviceWriteBps  []ThrottleDevice  `json:"device_write_bps,omitempty"`
+	DeviceReadIOps  []ThrottleDevice  `json:"device_read_iops,omitempty"`
+	DeviceWriteIOps []ThrottleDevice  `json:"device_write_iops,omitempty"`
+	Ulimits         []Ulimit          `json:"ulimits,omitempty"`
+	OomScoreAdj     *int              `json:"oom_score_adj,omitempty"`
+	Tmpfs           []Tmpfs           `json:"tmpfs,omitempty"`
+	DNS             []string          `json:"dns,omitempty"`
+	DNSSearch       []string          `json:"dns_search,omitempty"`
+	DNSOptions      []string          `json:"dns_options,omitempty"`
+	ExtraHosts      []string          `json:"extra_hosts,omitempty"`
+	Sysctls         map[string]string `json:"sysctls,omitempty"`
+	// Namespace modes: empty for a new namespace, host or container:<id>
+	PidMode     string `json:"pid_mode,omitempty"`
+	IpcMode     string `json:"ipc_mode,omitempty"`
+	UTSMode     string `json:"uts_mode,omitempty"`
+	NetworkMode string `json:"network_mode,omitempty"`
+	// Cgroup namespace mode: private or host
+	CgroupnsMode   string `json:"cgroupns_mode,omitempty"`
+	CgroupDelegate bool   `json:"cgroup_delegate,omitempty"`
+	// Clock offsets of the container's time namespace, by clock
+	TimeOffsets map[string]time.Duration `json:"time_offsets,omitempty"`
+	// Host devices and extra device cgroup rules in devices.allow format
+	Devices           []Device `json:"devices,omitempty"`
+	DeviceCgroupRules []string `json:"device_cgroup_rules,omitempty"`
+	// Landlock profile restricting the command's filesystem access
+	Landlock *landlock.Profile `json:"landlock,omitempty"`
+	// Health check options overriding the image's ones, zero values
+	// are inherited
+	Healthcheck   *v1.HealthConfig `json:"healthcheck,omitempty"`
+	NoHealthcheck bool             `json:"no_healthcheck,omitempty"`
+	// Detached containers are run by a monitor process, which restarts
+	// them according to their restart policy
+	Detach        bool          `json:"detach,omitempty"`
+	RestartPolicy RestartPolicy `json:"restart_policy"`
+	// Report prints the resource usage when the container exits
+	Report bool `json:"report,omitempty"`
+}
+
+// NewHostConfig returns a HostConfig without any limit
+func NewHostConfig(image string) *HostConfig {
+	return &HostConfig{
+		Image:  image,
+		Memory: cgroups.Unlimited,
+		Swap:   cgroups.Unlimited,
+		Pids:   cgroups.Unlimited,
+		CPUs:   cgroups.Unlimited,
+	}
+}
+
+// Validate checks that the host config options are consistent
+func (hc *HostConfig) Validate() error {
+	if err := hc.validateTmpfs(); err != nil {
+		return err
+	}
+	if err := ValidateDNS(hc.DNS); err != nil {
+		return err
+	}
+	if err := hc.validateNamespaces(); err != nil {
+		return err
+	}
+	if err := hc.validateCgroupns(); err != nil {
+		return err
+	}
+	if err := hc.validateDeviceCgroupRules(); err != nil {
+		return err
+	}
+	if err := hc.validateSysctls(); err != nil {
+		return err
+	}
+	if err := hc.validateHealthcheck(); err != nil {
+		return err
+	}
+	if err := hc.validateRestartPolicy(); err != nil {
+		return err
+	}
+	if err := hc.validateResources(); err != nil {
+		return err
+	}
+	return ValidateExtraHosts(hc.ExtraHosts)
+}
+
+// hostConfigPath returns the path of the container's host config file
+func (c *Container) hostConfigPath() string {
+	return filepath.Join(constants.KokerContainersPath, c.ID, "hostconfig.json")
+}
+
+// saveHostConfig writes container's host config file
+func (c *Container) saveHostConfig() error {
+	c.log.Debug().Msg("Save container host config to file")
+	b, err := json.Marshal(c.HostConfig)
+	if err != nil {
+		return errors.Wrap(err, "unable to marshal host config")
+	}
+	return os.WriteFile(c.hostConfigPath(), b, 0644)
+}
+
+// loadHostConfig reads container's host config file
+func (c *Container) loadHostConfig() error {
+	c.log.Debug().Msg("Load container host config from file")
+	data, err := os.ReadFile(c.hostConfigPath())
+	if err != nil {
+		return err
+	}
+	hc := new(HostConfig)
+	if err := json.Unmarshal(data, hc); err != nil {
+		return errors.Wrap(err, "unable to unmarshal host config")
+	}
+	c.HostConfig = hc
+	return nil
+}
@@ -0,0 +1,206 @@
+package containers
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/pkg/errors"
+
+	"github.com/ntk148v/koker/pkg/cgroups"
+	"github.com/ntk148v/koker/pkg/constants"
+	"github.com/ntk148v/koker/pkg/images"
+)
+
+// Inspect is the low-level information on a container, `container inspect`
+type Inspect struct {
+	ID    string `json:"id"`
+	Image string `json:"image"`
+	// Config is the effective config: the image's one with the options
+	Config          InspectConfig     `json:"config"`
+	State           *State            `json:"state"`
+	HostConfig      *HostConfig       `json:"host_config"`
+	Mounts          []MountPoint      `json:"mounts"`
+	NetworkSettings *NetworkSettings  `json:"network_settings"`
+	CgroupPaths     map[string]string `json:"cgroup_paths"`
+	// Memory is the effective memory settings, read from the cgroups
+	// while the container runs
+	Memory      *cgroups.MemorySettings `json:"memory,omitempty"`
+	GraphDriver GraphDriver             `json:"graph_driver"`
+}
+
+// InspectConfig is the config the container's command is run with
+type InspectConfig struct {
+	Hostname    string           `json:"hostname"`
+	Cmd         []string         `json:"cmd"`
+	Entrypoint  []string         `json:"entrypoint,omitempty"`
+	Env         []string         `json:"env"`
+	User        string           `json:"user,omitempty"`
+	WorkingDir  string           `json:"working_dir"`
+	Healthcheck *v1.HealthConfig `json:"healthcheck,omitempty"`
+}
+
+// MountPoint is a filesystem mounted in the container
+type MountPoint struct {
+	Type        string `json:"type"`
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	Options     string `json:"options,omitempty"`
+	RW          bool   `json:"rw"`
+}
+
+// NetworkSettings are the network settings of a container, its
+// addresses are only known while it runs on the bridge network.
+type NetworkSettings struct {
+	Mode       string `json:"mode"`
+	Bridge     string `json:"bridge,omitempty"`
+	IPAddress  string `json:"ip_address,omitempty"`
+	Gateway    string `json:"gateway,omitempty"`
+	MacAddress string `json:"mac_address,omitempty"`
+	// Veth pair ends: on the host, and in the container once renamed
+	HostVeth      string `json:"host_veth,omitempty"`
+	ContainerVeth string `json:"container_veth,omitempty"`
+	SandboxKey    string `json:"sandbox_key,omitempty"`
+}
+
+// GraphDriver describes the storage of the container's root filesystem
+type GraphDriver struct {
+	Name string            `json:"name"`
+	Data map[string]string `json:"data"`
+}
+
+// Inspect returns the low-level information on the container
+func (c *Container) Inspect() (*Inspect, error) {
+	if err := c.loadHostConfig(); err != nil {
+		return nil, err
+	}
+	// The image config is copied once the root filesystem is prepared
+	if err := c.loadImageConfig(); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	state, err := c.loadState()
+	if err != nil {
+		return nil, err
+	}
+
+	hc := c.HostConfig
+	workingDir := c.Config.WorkingDir
+	if workingDir == "" {
+		workingDir = "/"
+	}
+	networkSettings := &NetworkSettings{}
+	if state.Network != nil {
+		*networkSettings = *state.Network
+	}
+	networkSettings.Mode = hc.NetworkMode
+
+	status := state.status()
+	if status == StatusRunning && c.paused() {
+		status = StatusPaused
+	}
+	state.Status, state.Network = status, nil
+
+	var memory *cgroups.MemorySettings
+	if state.running() {
+		if memory, err = c.cg.MemorySettings(); err != nil {
+			return nil, errors.Wrap(err, "unable to read container's memory settings")
+		}
+	}
+
+	return &Inspect{
+		ID:    c.ID,
+		Image: c.imageName(),
+		Config: InspectConfig{
+			Hostname:    hc.Hostname,
+			Cmd:         c.commandArgs(hc.Cmd),
+			Entrypoint:  c.Config.Entrypoint,
+			Env:         c.Config.Env,
+			User:        c.Config.User,
+			WorkingDir:  workingDir,
+			Healthcheck: c.healthConfig(),
+		},
+		State:           state,
+		HostConfig:      hc,
+		Mounts:          c.mountPoints(),
+		NetworkSettings: networkSettings,
+		CgroupPaths:     c.cg.Paths(),
+		Memory:          memory,
+		GraphDriver:     c.graphDriver(),
+	}, nil
+}
+
+// networkSettings returns the settings of the bridge network, once set up
+func (c *Container) networkSettings() *NetworkSettings {
+	return &NetworkSettings{
+		Bridge:        constants.KokerBridgeName,
+		IPAddress:     c.ipAddress,
+		Gateway:       constants.KokerBridgeDefaultIP,
+		MacAddress:    c.macAddress,
+		HostVeth:      c.vethName(),
+		ContainerVeth: constants.KokerCtrEthName,
+		SandboxKey:    c.netnsPath(),
+	}
+}
+
+// mountPoints returns the filesystems mounted in the container
+func (c *Container) mountPoints() []MountPoint {
+	hc := c.HostConfig
+	dir := filepath.Join(constants.KokerContainersPath, c.ID)
+	mounts := []MountPoint{
+		{Type: "overlay", Source: c.RootFS, Destination: "/", RW: !hc.ReadOnly},
+		{Type: "proc", Source: "proc", Destination: "/proc", RW: true},
+		{Type: "sysfs", Source: "sysfs", Destination: "/sys", RW: hc.Privileged},
+	}
+	if hc.Privileged {
+		mounts = append(mounts, MountPoint{Type: "bind", Source: "/dev", Destination: "/dev", RW: true})
+	} else {
+		mounts = append(mounts, MountPoint{Type: "tmpfs", Source: "tmpfs", Destination: "/dev", RW: true})
+	}
+	if hc.privateCgroupns() {
+		mounts = append(mounts, MountPoint{Type: "cgroup", Source: "cgroup",
+			Destination: cgroupMountpoint, RW: hc.CgroupDelegate || hc.Privileged})
+	}
+	for _, m := range c.tmpfsMountPoints(c.RootFS) {
+		mounts = append(mounts, MountPoint{Type: m.Type, Source: m.Source, Destination: m.Target,
+			Options: m.Option, RW: m.Flag&syscall.MS_RDONLY == 0})
+	}
+	for _, file := range etcFiles {
+		mounts = append(mounts, MountPoint{Type: "bind", Source: filepath.Join(dir, file),
+			Destination: filepath.Join("/etc", file), RW: true})
+	}
+	return mounts
+}
+
+// graphDriver returns the overlay directories of the container's root
+// filesystem. The image layers are only listed if the image is pulled.
+func (c *Container) graphDriver() GraphDriver {
+	dir := filepath.Join(constants.KokerContainersPath, c.ID)
+	data := map[string]string{"merged_dir": c.RootFS}
+	if !c.HostConfig.ReadOnly {
+		data["upper_dir"] = filepath.Join(dir, "diff")
+		data["work_dir"] = filepath.Join(dir, "work")
+	}
+	if c.imagePulled() {
+		if layers, err := c.rootFSLayers(); err == nil {
+			data["lower_dir"] = strings.Join(layers, ":")
+		}
+	}
+	return GraphDriver{Name: "overlay", Data: data}
+}
+
+// imagePulled reports whether the root filesystem is available without
+// pulling the container's image
+func (c *Container) imagePulled() bool {
+	if c.rootFSDir() != "" {
+		return true
+	}
+	tag, err := name.NewTag(c.HostConfig.Image)
+	if err != nil {
+		return false
+	}
+	_, ok := images.GetImage(tag.Name())
+	return ok
+}
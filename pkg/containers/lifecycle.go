@@ -0,0 +1,417 @@
+package containers
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/ntk148v/koker/pkg/constants"
+	"github.com/ntk148v/koker/pkg/reexec"
+)
+
+// stopKillTimeout is how long `container stop` waits for the monitor
+// once the container is killed
+const stopKillTimeout = 10 * time.Second
+
+// startFailedExitCode is the exit code of a container which couldn't
+// be started, like docker run does
+const startFailedExitCode = 125
+
+// logPath returns the path of the log file of a detached container
+func (c *Container) logPath() string {
+	return filepath.Join(constants.KokerContainersPath, c.ID, "container.log")
+}
+
+// Detach runs the container in the background: a monitor process runs
+// and supervises it, the output goes to the container's log file.
+func (c *Container) Detach(hc *HostConfig, cmds []string, quiet, debug bool) error {
+	hc.Cmd = cmds
+	c.HostConfig = hc
+	if err := c.prepareDir(); err != nil {
+		return err
+	}
+	if err := c.saveHostConfig(); err != nil {
+		return errors.Wrap(err, "unable to save host config")
+	}
+	return c.startMonitor(quiet, debug)
+}
+
+// startMonitor starts the monitor process of a detached container,
+// `container monitor`, in its own session.
+func (c *Container) startMonitor(quiet, debug bool) error {
+	c.log.Info().Msg("Start container monitor")
+	logFile, err := os.OpenFile(c.logPath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.Wrap(err, "unable to open container log file")
+	}
+	defer logFile.Close()
+
+	c.updateState(func(s *State) {
+		*s = State{Status: StatusCreated}
+	})
+
+	cmd := reexec.Command(append(logArgs(quiet, debug), "container", "monitor", c.ID)...)
+	cmd.Stdout, cmd.Stderr = logFile, logFile
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return errors.Wrap(err, "unable to start container monitor")
+	}
+	return cmd.Process.Release()
+}
+
+// Monitor runs a detached container, it is called by the monitor process
+func (c *Container) Monitor(quiet, debug bool) error {
+	if err := c.loadHostConfig(); err != nil {
+		return err
+	}
+	// The container can be stopped while it is prepared
+	c.updateState(func(s *State) {
+		s.MonitorPid = os.Getpid()
+	})
+	err := c.Run(c.HostConfig, c.HostConfig.Cmd, quiet, debug)
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		// The container failed before or while being started
+		c.updateState(func(s *State) {
+			s.Status, s.Pid, s.ExitCode = StatusExited, 0, startFailedExitCode
+			s.ExitReason, s.FinishedAt = err.Error(), time.Now()
+		})
+	}
+	return err
+}
+
+// supervise starts the container's child and waits for it. The child is
+// started again as long as the restart policy allows it, until the
+// monitor receives SIGTERM from `container stop` on sigc.
+func (c *Container) supervise(sigc <-chan os.Signal, start func() (*exec.Cmd, error)) error {
+	var (
+		stopped atomic.Bool
+		// current is the running child, nil while it is started, and
+		// exited is closed once it is waited for
+		currentMu sync.Mutex
+		current   *exec.Cmd
+		exited    chan struct{}
+	)
+	c.updateState(func(s *State) {
+		s.MonitorPid, s.ManuallyStopped = os.Getpid(), false
+	})
+	stop, finished := make(chan struct{}), make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-sigc:
+		case <-finished:
+			return
+		}
+		c.log.Info().Msg("Stop container")
+		stopped.Store(true)
+		close(stop)
+		c.updateState(func(s *State) {
+			s.ManuallyStopped = true
+		})
+		// The child forwards it to the container's command, and exits
+		// with it. A child being started is stopped once it is.
+		currentMu.Lock()
+		if current != nil {
+			go terminate(current, exited)
+		}
+		currentMu.Unlock()
+	}()
+
+	var delay time.Duration
+	for {
+		// The OOM kill counter of the cgroups is kept across restarts
+		oomKills, _ := c.cg.OOMKillCount()
+		cmd, err := start()
+		if err != nil {
+			return err
+		}
+		currentMu.Lock()
+		current, exited = cmd, make(chan struct{})
+		currentMu.Unlock()
+		if stopped.Load() {
+			go terminate(cmd, exited)
+		}
+		started := time.Now()
+		c.updateState(func(s *State) {
+			s.Status, s.Pid, s.StartedAt = StatusRunning, cmd.Process.Pid, started
+		})
+
+		err = c.wait(cmd)
+		currentMu.Lock()
+		close(exited)
+		current = nil
+		currentMu.Unlock()
+		var exitErr *exec.ExitError
+		if err != nil && !errors.As(err, &exitErr) {
+			return err
+		}
+		exitCode, reason := 0, "exit status 0"
+		if exitErr != nil {
+			exitCode, reason = ExitStatus(exitErr), exitErr.Error()
+		}
+		if stopped.Load() {
+			reason = "stopped"
+		}
+		c.log.Info().Int("exit_code", exitCode).Str("reason", reason).Msg("Container exited")
+		oomKilled := false
+		if n, err := c.cg.OOMKillCount(); err == nil {
+			oomKilled = n > oomKills
+		}
+		var restartCount int
+		c.updateState(func(s *State) {
+			s.Status, s.Pid, s.ExitCode, s.ExitReason = StatusExited, 0, exitCode, reason
+			s.OOMKilled, s.FinishedAt, restartCount = oomKilled, time.Now(), s.RestartCount
+		})
+		if stopped.Load() || !c.HostConfig.RestartPolicy.shouldRestart(exitCode, restartCount) {
+			return err
+		}
+
+		delay = nextRestartDelay(delay, time.Since(started))
+		c.log.Info().Dur("delay", delay).Msg("Restart container")
+		c.updateState(func(s *State) {
+			s.Status = StatusRestarting
+			s.RestartCount++
+		})
+		select {
+		case <-time.After(delay):
+		case <-stop:
+			c.updateState(func(s *State) {
+				s.Status = StatusExited
+			})
+			return err
+		}
+	}
+}
+
+// terminateInterval is how often SIGTERM is sent to a stopped child
+const terminateInterval = 100 * time.Millisecond
+
+// terminate sends SIGTERM to the child until it has exited. The child
+// is the init of its PID namespace, which ignores the signal until its
+// handler is set, right after it is started.
+func terminate(cmd *exec.Cmd, exited <-chan struct{}) {
+	ticker := time.NewTicker(terminateInterval)
+	defer ticker.Stop()
+	for {
+		cmd.Process.Signal(syscall.SIGTERM)
+		select {
+		case <-exited:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// wait waits for the container's child, running the health check meanwhile
+func (c *Container) wait(cmd *exec.Cmd) error {
+	if health := c.healthConfig(); health != nil {
+		stop, done := make(chan struct{}), make(chan struct{})
+		go func() {
+			c.monitorHealth(health, stop)
+			close(done)
+		}()
+		// Let a running check finish before the container is deleted
+		defer func() {
+			close(stop)
+			<-done
+		}()
+	}
+	return cmd.Wait()
+}
+
+// Start starts a stopped detached container with a new monitor
+func (c *Container) Start(quiet, debug bool) error {
+	if err := c.loadHostConfig(); err != nil {
+		return err
+	}
+	state, err := c.loadState()
+	if err != nil {
+		return err
+	}
+	if state.running() {
+		return errors.Errorf("container %s is already running", c.ID)
+	}
+	if !c.HostConfig.Detach {
+		return errors.Errorf("container %s wasn't detached, it can't be started again", c.ID)
+	}
+	if err := c.removeLeftovers(); err != nil {
+		return err
+	}
+	return c.startMonitor(quiet, debug)
+}
+
+// StartRestartable starts the detached containers which should be running
+// according to their restart policy but whose monitor is gone, after a
+// reboot for instance.
+func StartRestartable(quiet, debug bool) error {
+	files, err := os.ReadDir(constants.KokerContainersPath)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if !file.IsDir() {
+			continue
+		}
+		c, err := NewContainer(file.Name())
+		if err != nil {
+			return err
+		}
+		if err := c.loadHostConfig(); err != nil {
+			return err
+		}
+		state, err := c.loadState()
+		if err != nil {
+			return err
+		}
+		if state.running() || !c.HostConfig.Detach || !c.HostConfig.RestartPolicy.restartOnBoot(state) {
+			continue
+		}
+		if err := c.Start(quiet, debug); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stop stops a running container: its monitor is sent SIGTERM, which it
+// forwards to the container's command. The container is killed if it is
+// still running after timeout.
+func (c *Container) Stop(timeout time.Duration) error {
+	state, err := c.loadState()
+	if err != nil {
+		return err
+	}
+	if !state.running() {
+		return errors.Errorf("container %s is not running", c.ID)
+	}
+
+	c.log.Info().Dur("timeout", timeout).Msg("Stop container")
+	if err := syscall.Kill(state.MonitorPid, syscall.SIGTERM); err != nil {
+		return errors.Wrap(err, "unable to signal container monitor")
+	}
+	// A paused container gets the signal once it is thawed
+	if c.paused() {
+		if err := c.cg.Thaw(); err != nil {
+			return errors.Wrap(err, "unable to unpause container")
+		}
+	}
+	if waitExit(state.MonitorPid, timeout) {
+		return nil
+	}
+
+	c.log.Warn().Msg("Container didn't stop in time, kill it")
+	pids, err := c.cg.GetPids()
+	if err != nil {
+		return err
+	}
+	for _, pid := range pids {
+		if pid, err := strconv.Atoi(pid); err == nil {
+			syscall.Kill(pid, syscall.SIGKILL)
+		}
+	}
+	if !waitExit(state.MonitorPid, stopKillTimeout) {
+		return errors.Errorf("container %s monitor didn't exit", c.ID)
+	}
+	return nil
+}
+
+// Pause suspends the processes of a running container by freezing
+// its cgroups
+func (c *Container) Pause() error {
+	state, err := c.loadState()
+	if err != nil {
+		return err
+	}
+	if !state.running() {
+		return errors.Errorf("container %s is not running", c.ID)
+	}
+	if c.paused() {
+		return errors.Errorf("container %s is already paused", c.ID)
+	}
+	c.log.Info().Msg("Pause container")
+	return errors.Wrap(c.cg.Freeze(), "unable to freeze container cgroups")
+}
+
+// Unpause resumes the processes of a paused container
+func (c *Container) Unpause() error {
+	if !c.paused() {
+		return errors.Errorf("container %s is not paused", c.ID)
+	}
+	c.log.Info().Msg("Unpause container")
+	return errors.Wrap(c.cg.Thaw(), "unable to thaw container cgroups")
+}
+
+// paused reports whether the container's cgroups are frozen
+func (c *Container) paused() bool {
+	frozen, err := c.cg.Frozen()
+	return err == nil && frozen
+}
+
+// waitExit waits up to timeout for a process to exit
+func waitExit(pid int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for syscall.Kill(pid, 0) == nil {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return true
+}
+
+// Remove deletes a container, a running one is killed if force is set
+func (c *Container) Remove(force bool) error {
+	state, err := c.loadState()
+	if err != nil {
+		return err
+	}
+	if state.running() {
+		if !force {
+			return errors.Errorf("container %s is running, stop it first or force the removal", c.ID)
+		}
+		if err := c.Stop(0); err != nil {
+			return err
+		}
+	}
+	// Foreground containers delete themselves
+	if _, err := os.Stat(filepath.Join(constants.KokerContainersPath, c.ID)); os.IsNotExist(err) {
+		return nil
+	}
+	if err := c.removeLeftovers(); err != nil {
+		return err
+	}
+	return c.delete()
+}
+
+// removeLeftovers removes the mounts of a container whose monitor didn't
+// exit cleanly, after a reboot for instance, along with its network
+// namespace and cgroups. Most of the time there is nothing to remove.
+func (c *Container) removeLeftovers() error {
+	for _, target := range []string{c.RootFS, c.netnsPath()} {
+		syscall.Unmount(target, syscall.MNT_DETACH)
+	}
+	if err := c.cleanup(); err != nil {
+		return errors.Wrap(err, "unable to remove container leftovers")
+	}
+	return nil
+}
+
+// logArgs returns the global options passed to re-executed koker
+// processes, so that quiet and debug modes work in them.
+func logArgs(quiet, debug bool) []string {
+	if quiet {
+		return []string{"-q"}
+	}
+	if debug {
+		return []string{"-D"}
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package containers
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// Namespace modes of --pid, --ipc, --uts and --network. The empty mode
+// is a new namespace for the container.
+const (
+	NamespaceHost = "host"
+	NetworkBridge = "bridge"
+	NetworkNone   = "none"
+
+	containerModePrefix = "container:"
+)
+
+// namespace is a namespace which can be shared with the host
+// or another container
+type namespace struct {
+	// name in /proc/<pid>/ns
+	name string
+	flag int
+	mode func(hc *HostConfig) string
+}
+
+var sharedNamespaces = []namespace{
+	{"uts", syscall.CLONE_NEWUTS, func(hc *HostConfig) string { return hc.UTSMode }},
+	{"ipc", syscall.CLONE_NEWIPC, func(hc *HostConfig) string { return hc.IpcMode }},
+	{"net", syscall.CLONE_NEWNET, func(hc *HostConfig) string { return hc.NetworkMode }},
+	{"pid", syscall.CLONE_NEWPID, func(hc *HostConfig) string { return hc.PidMode }},
+}
+
+// namespaceContainer returns the container id of a container:<id> mode
+func namespaceContainer(mode string) (string, bool) {
+	id, ok := strings.CutPrefix(mode, containerModePrefix)
+	return id, ok && id != ""
+}
+
+// validateNamespaces checks the namespace modes
+func (hc *HostConfig) validateNamespaces() error {
+	for _, ns := range sharedNamespaces {
+		mode := ns.mode(hc)
+		if _, ok := namespaceContainer(mode); ok || mode == "" || mode == NamespaceHost {
+			continue
+		}
+		if ns.name == "net" && (mode == NetworkBridge || mode == NetworkNone) {
+			continue
+		}
+		return errors.Errorf("invalid %s namespace mode %q", ns.name, mode)
+	}
+	if hc.Hostname != "" && hc.UTSMode != "" {
+		return errors.New("hostname can't be set when sharing the UTS namespace")
+	}
+	return nil
+}
+
+// validateRootlessNamespaces checks the namespace modes of a rootless
+// container. It can't mount /proc and /sys of namespaces owned by the
+// host, nor join the namespaces of another user namespace.
+func (hc *HostConfig) validateRootlessNamespaces() error {
+	for _, ns := range sharedNamespaces {
+		mode := ns.mode(hc)
+		if _, ok := namespaceContainer(mode); ok {
+			return errors.Errorf("%s namespace of another container can't be joined in rootless mode", ns.name)
+		}
+		if mode == NamespaceHost && (ns.name == "net" || ns.name == "pid") {
+			return errors.Errorf("host %s namespace can't be used in rootless mode", ns.name)
+		}
+	}
+	return nil
+}
+
+// bridgeNetwork reports whether the container is attached to the bridge
+func (hc *HostConfig) bridgeNetwork() bool {
+	return hc.NetworkMode == "" || hc.NetworkMode == NetworkBridge
+}
+
+// privateNetwork reports whether the container has its own network namespace
+func (hc *HostConfig) privateNetwork() bool {
+	return hc.bridgeNetwork() || hc.NetworkMode == NetworkNone
+}
+
+// cloneFlags returns the namespaces created with the container's child:
+// the mount namespace and the ones which aren't shared. The network
+// namespace of a bridged container is created beforehand, unless rootless.
+func (hc *HostConfig) cloneFlags(rootless bool) uintptr {
+	flags := uintptr(syscall.CLONE_NEWNS)
+	for _, ns := range sharedNamespaces {
+		mode := ns.mode(hc)
+		if ns.name == "net" {
+			if mode == NetworkNone || (rootless && hc.bridgeNetwork()) {
+				flags |= syscall.CLONE_NEWNET
+			}
+		} else if mode == "" {
+			flags |= uintptr(ns.flag)
+		}
+	}
+	return flags
+}
+
+// namespaceTarget returns the running container of a container:<id> mode
+func namespaceTarget(mode string) (*Container, string, error) {
+	id, _ := namespaceContainer(mode)
+	target, err := NewContainer(id)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := target.LoadConfig(); err != nil {
+		return nil, "", errors.Wrapf(err, "unable to load container %s", id)
+	}
+	pid, err := target.getMainPid()
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "container %s isn't running", id)
+	}
+	return target, pid, nil
+}
+
+// sharedHostname returns the hostname of a shared UTS namespace
+func (c *Container) sharedHostname() (string, error) {
+	if c.HostConfig.UTSMode == NamespaceHost {
+		return os.Hostname()
+	}
+	target, _, err := namespaceTarget(c.HostConfig.UTSMode)
+	if err != nil {
+		return "", err
+	}
+	return target.HostConfig.Hostname, nil
+}
+
+// joinedNamespaces returns the namespaces of other containers to
+// join, as /proc/<pid>/ns paths by clone flag.
+func (c *Container) joinedNamespaces() (map[int]string, error) {
+	joined := make(map[int]string)
+	for _, ns := range sharedNamespaces {
+		mode := ns.mode(c.HostConfig)
+		if _, ok := namespaceContainer(mode); !ok {
+			continue
+		}
+		_, pid, err := namespaceTarget(mode)
+		if err != nil {
+			return nil, err
+		}
+		c.log.Debug().Str("namespace", ns.name).Str("mode", mode).Msg("Join namespace of container")
+		joined[ns.flag] = filepath.Join("/proc", pid, "ns", ns.name)
+	}
+	return joined, nil
+}
+
+// startInNamespaces calls start from a thread which joined the given
+// namespaces, so that the started child inherits them.
+func startInNamespaces(namespaces map[int]string, start func() error) error {
+	if len(namespaces) == 0 {
+		return start()
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		// The thread is never unlocked: it terminates with the goroutine
+		// rather than being reused in the joined namespaces.
+		runtime.LockOSThread()
+		for flag, path := range namespaces {
+			f, err := os.Open(path)
+			if err != nil {
+				errc <- errors.Wrapf(err, "can't open %s", path)
+				return
+			}
+			err = unix.Setns(int(f.Fd()), flag)
+			f.Close()
+			if err != nil {
+				errc <- errors.Wrapf(err, "can't setns to %s", path)
+				return
+			}
+		}
+		errc <- start()
+	}()
+	return <-errc
+}
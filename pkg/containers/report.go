@@ -0,0 +1,74 @@
+package containers
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/ntk148v/koker/pkg/network"
+	"github.com/ntk148v/koker/pkg/utils"
+)
+
+// ResourceUsage is the resources used by a container over its lifetime,
+// restarts included. It is read from its cgroups when it exits.
+type ResourceUsage struct {
+	CPUUser   time.Duration `json:"cpu_user"`
+	CPUSystem time.Duration `json:"cpu_system"`
+	// MemoryPeak in bytes, PidsPeak are 0 if the kernel doesn't record them
+	MemoryPeak uint64 `json:"memory_peak"`
+	PidsPeak   uint64 `json:"pids_peak"`
+	OOMKills   int    `json:"oom_kills"`
+	ReadBytes  uint64 `json:"read_bytes"`
+	WriteBytes uint64 `json:"write_bytes"`
+	// Network bytes received and transmitted, on the bridge network
+	NetRx uint64 `json:"net_rx"`
+	NetTx uint64 `json:"net_tx"`
+}
+
+// recordUsage reads the container's resource usage into its state, and
+// prints it with --report. It must be called once the container exited,
+// before its cgroups and veth are removed.
+func (c *Container) recordUsage() {
+	stats, err := c.cg.Stats()
+	if err != nil {
+		c.log.Warn().Err(err).Msg("Unable to read container resource usage")
+		return
+	}
+	usage := &ResourceUsage{
+		CPUUser:    time.Duration(stats.CPU.User),
+		CPUSystem:  time.Duration(stats.CPU.System),
+		MemoryPeak: stats.Memory.Peak,
+		PidsPeak:   stats.Pids.Peak,
+		ReadBytes:  stats.IO.ReadBytes,
+		WriteBytes: stats.IO.WriteBytes,
+	}
+	usage.OOMKills, _ = c.cg.OOMKillCount()
+	if c.HostConfig.bridgeNetwork() && c.ipAddress != "" {
+		// The host end receives what the container transmits
+		if tx, rx, err := network.LinkStatistics(c.vethName()); err == nil {
+			usage.NetRx, usage.NetTx = rx, tx
+		}
+	}
+
+	c.updateState(func(s *State) {
+		s.ResourceUsage = usage
+	})
+	if c.HostConfig.Report {
+		usage.print(c.ID)
+	}
+}
+
+// print writes the resource usage report to stderr, which keeps the
+// container's output apart
+func (u *ResourceUsage) print(id string) {
+	fmt.Fprintf(os.Stderr, "Resource usage of container %s:\n", id)
+	fmt.Fprintf(os.Stderr, "  CPU time:    %s user, %s system\n",
+		u.CPUUser.Round(time.Millisecond), u.CPUSystem.Round(time.Millisecond))
+	fmt.Fprintf(os.Stderr, "  Peak memory: %s\n", utils.HumanSize(u.MemoryPeak))
+	fmt.Fprintf(os.Stderr, "  OOM kills:   %d\n", u.OOMKills)
+	fmt.Fprintf(os.Stderr, "  Peak pids:   %d\n", u.PidsPeak)
+	fmt.Fprintf(os.Stderr, "  Block I/O:   %s read, %s written\n",
+		utils.HumanSize(u.ReadBytes), utils.HumanSize(u.WriteBytes))
+	fmt.Fprintf(os.Stderr, "  Network I/O: %s received, %s transmitted\n",
+		utils.HumanSize(u.NetRx), utils.HumanSize(u.NetTx))
+}
@@ -0,0 +1,207 @@
+package containers
+
+import (
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+
+	"github.com/ntk148v/koker/pkg/cgroups"
+	"github.com/ntk148v/koker/pkg/utils"
+)
+
+// Bytes is a memory size in bytes, cgroups.Unlimited for no limit
+type Bytes int64
+
+// bytesRe matches memory sizes: a number, possibly fractional, with an
+// optional b, k, m, g or t unit
+var bytesRe = regexp.MustCompile(`^([0-9]+(?:\.[0-9]+)?)([bkmgt]?)(?:i?b)?$`)
+
+// bytesUnits are the binary multipliers of the memory size units
+var bytesUnits = map[string]float64{
+	"b": 1,
+	"k": 1 << 10,
+	"m": 1 << 20,
+	"g": 1 << 30,
+	"t": 1 << 40,
+}
+
+// ParseBytes parses a memory size such as 512m or 1.5g. A number without
+// unit is in MB, max or -1 is no limit.
+func ParseBytes(s string) (Bytes, error) {
+	return parseBytes(s, "m")
+}
+
+// parseBytes parses a size, in unit without unit
+func parseBytes(s, unit string) (Bytes, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "max" || s == "-1" {
+		return cgroups.Unlimited, nil
+	}
+	m := bytesRe.FindStringSubmatch(s)
+	if m == nil {
+		return 0, errors.Errorf("invalid size %q, expected a number with a b, k, m, g or t unit, or max", s)
+	}
+	value, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, errors.Errorf("invalid size %q", s)
+	}
+	if m[2] != "" {
+		unit = m[2]
+	}
+	return Bytes(value * bytesUnits[unit]), nil
+}
+
+func (b Bytes) String() string {
+	if b < 0 {
+		return "max"
+	}
+	return utils.HumanSize(uint64(b))
+}
+
+// ParseCPUs parses a number of CPUs, possibly fractional such as 0.25,
+// or max for no limit
+func ParseCPUs(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+	if s == "max" || s == "-1" {
+		return cgroups.Unlimited, nil
+	}
+	cpus, err := strconv.ParseFloat(s, 64)
+	if err != nil || cpus <= 0 {
+		return 0, errors.Errorf("invalid number of CPUs %q", s)
+	}
+	return cpus, nil
+}
+
+// SwapLimit returns the swap limit of a --memory-swap limit, the total of
+// memory and swap like docker does. Unlimited is unlimited swap.
+func SwapLimit(memory, memorySwap Bytes) (Bytes, error) {
+	if memorySwap < 0 {
+		return cgroups.Unlimited, nil
+	}
+	if memory <= 0 {
+		return 0, errors.New("--memory-swap requires a memory limit")
+	}
+	if memorySwap < memory {
+		return 0, errors.Errorf("memory and swap limit %s is below the memory limit %s", memorySwap, memory)
+	}
+	return memorySwap - memory, nil
+}
+
+// SetMemory sets the memory limit, and the swap limit from memorySwap,
+// the total of memory and swap, unless it is 0. Without it, a container
+// which had no memory limit gets as much swap as memory like at run
+// time, the others keep their swap limit.
+func (hc *HostConfig) SetMemory(memory, memorySwap Bytes) error {
+	limited := hc.Memory > 0
+	hc.Memory = memory
+	switch {
+	case memorySwap != 0:
+		swap, err := SwapLimit(memory, memorySwap)
+		if err != nil {
+			return err
+		}
+		hc.Swap = swap
+	case memory <= 0:
+		hc.Swap = cgroups.Unlimited
+	case !limited:
+		// Like docker, as much swap as memory by default
+		hc.Swap = memory
+	}
+	return nil
+}
+
+// minCPUs is the lowest CPU limit, the kernel's minimum CFS quota
+const minCPUs = 0.01
+
+// CFS periods range, in microseconds. The minimum quota is the minimum
+// period.
+const (
+	minCPUPeriod = 1000
+	maxCPUPeriod = 1000000
+)
+
+// validateResources checks the resource limits
+func (hc *HostConfig) validateResources() error {
+	if hc.Memory > 0 && hc.MemoryReservation > hc.Memory {
+		return errors.Errorf("memory reservation %s exceeds the memory limit %s", hc.MemoryReservation, hc.Memory)
+	}
+	if hc.Memory > 0 && hc.MemoryHigh > hc.Memory {
+		return errors.Errorf("memory high limit %s exceeds the memory limit %s", hc.MemoryHigh, hc.Memory)
+	}
+	if s := hc.MemorySwappiness; s != nil && (*s < 0 || *s > 100) {
+		return errors.Errorf("memory swappiness %d out of range [0, 100]", *s)
+	}
+	if hc.CPUs > 0 && hc.CPUs < minCPUs {
+		return errors.Errorf("%g CPUs requested, the minimum is %g", hc.CPUs, minCPUs)
+	}
+	if hc.CPUs > float64(runtime.NumCPU()) {
+		return errors.Errorf("%g CPUs requested, only %d available", hc.CPUs, runtime.NumCPU())
+	}
+	if hc.CPUs > 0 && (hc.CPUPeriod != 0 || hc.CPUQuota != 0) {
+		return errors.New("CPUs and CPU period or quota can't both be set")
+	}
+	if hc.CPUPeriod != 0 && (hc.CPUPeriod < minCPUPeriod || hc.CPUPeriod > maxCPUPeriod) {
+		return errors.Errorf("CPU period %d out of range [%d, %d]", hc.CPUPeriod, minCPUPeriod, maxCPUPeriod)
+	}
+	if hc.CPUQuota != 0 && hc.CPUQuota != cgroups.Unlimited && hc.CPUQuota < minCPUPeriod {
+		return errors.Errorf("CPU quota %d is below the minimum %d", hc.CPUQuota, minCPUPeriod)
+	}
+	if hc.CPUShares != 0 && hc.CPUWeight != 0 {
+		return errors.New("CPU shares and weight can't both be set")
+	}
+	if hc.CPUShares != 0 && (hc.CPUShares < cgroups.MinCPUShares || hc.CPUShares > cgroups.MaxCPUShares) {
+		return errors.Errorf("CPU shares %d out of range [%d, %d]", hc.CPUShares, cgroups.MinCPUShares, cgroups.MaxCPUShares)
+	}
+	if hc.CPUWeight != 0 && (hc.CPUWeight < cgroups.MinCPUWeight || hc.CPUWeight > cgroups.MaxCPUWeight) {
+		return errors.Errorf("CPU weight %d out of range [%d, %d]", hc.CPUWeight, cgroups.MinCPUWeight, cgroups.MaxCPUWeight)
+	}
+	if hc.BlkioWeight != 0 && (hc.BlkioWeight < cgroups.MinBlkioWeight || hc.BlkioWeight > cgroups.MaxBlkioWeight) {
+		return errors.Errorf("block I/O weight %d out of range [%d, %d]", hc.BlkioWeight, cgroups.MinBlkioWeight, cgroups.MaxBlkioWeight)
+	}
+	for _, list := range []string{hc.CpusetCPUs, hc.CpusetMems} {
+		if list == "" {
+			continue
+		}
+		if _, err := parseCPUList(list); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// swapOff reports whether the container can't use swap: its swap limit
+// is 0, or the host has none
+func (hc *HostConfig) swapOff() bool {
+	if hc.Swap == 0 {
+		return true
+	}
+	var info unix.Sysinfo_t
+	return unix.Sysinfo(&info) == nil && info.Totalswap == 0
+}
+
+// parseCPUList parses a list of CPUs or memory nodes in cpuset format:
+// comma separated numbers and ranges, such as 0-2,4
+func parseCPUList(s string) ([]int, error) {
+	var cpus []int
+	for _, part := range strings.Split(s, ",") {
+		first, last, isRange := strings.Cut(part, "-")
+		start, err := strconv.Atoi(first)
+		if err != nil || start < 0 {
+			return nil, errors.Errorf("invalid cpuset list %q", s)
+		}
+		end := start
+		if isRange {
+			if end, err = strconv.Atoi(last); err != nil || end < start {
+				return nil, errors.Errorf("invalid cpuset list %q", s)
+			}
+		}
+		for i := start; i <= end; i++ {
+			cpus = append(cpus, i)
+		}
+	}
+	return cpus, nil
+}
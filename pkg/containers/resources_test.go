@@ -0,0 +1,53 @@
+package containers
+
+import (
+	"testing"
+
+	"github.com/ntk148v/koker/pkg/cgroups"
+)
+
+func TestSetMemory(t *testing.T) {
+	const m = 1 << 20
+	limited := func(memory, swap Bytes) *HostConfig {
+		hc := NewHostConfig("")
+		hc.Memory, hc.Swap = memory, swap
+		return hc
+	}
+	tests := []struct {
+		name       string
+		hc         *HostConfig
+		memory     Bytes
+		memorySwap Bytes
+		wantMemory Bytes
+		wantSwap   Bytes
+		wantErr    bool
+	}{
+		{"unlimited container", NewHostConfig(""), 1024 * m, 0, 1024 * m, 1024 * m, false},
+		{"unlimited container with memory-swap", NewHostConfig(""), 512 * m, 768 * m, 512 * m, 256 * m, false},
+		{"unlimited container with unlimited swap", NewHostConfig(""), 512 * m, cgroups.Unlimited, 512 * m, cgroups.Unlimited, false},
+		{"limited container keeps its swap", limited(256*m, 128*m), 512 * m, 0, 512 * m, 128 * m, false},
+		{"limited container keeps no swap", limited(256*m, 0), 512 * m, 0, 512 * m, 0, false},
+		{"limit removed", limited(256*m, 128*m), cgroups.Unlimited, 0, cgroups.Unlimited, cgroups.Unlimited, false},
+		{"memory-swap only", limited(256*m, 0), 256 * m, 512 * m, 256 * m, 256 * m, false},
+		{"memory-swap below memory", NewHostConfig(""), 512 * m, 256 * m, 0, 0, true},
+		{"memory-swap without memory", NewHostConfig(""), cgroups.Unlimited, 512 * m, 0, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.hc.SetMemory(tt.memory, tt.memorySwap)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.hc.Memory != tt.wantMemory || tt.hc.Swap != tt.wantSwap {
+				t.Errorf("got memory %d and swap %d, want %d and %d",
+					tt.hc.Memory, tt.hc.Swap, tt.wantMemory, tt.wantSwap)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package containers
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Restart policies of --restart
+const (
+	RestartNo            = "no"
+	RestartOnFailure     = "on-failure"
+	RestartAlways        = "always"
+	RestartUnlessStopped = "unless-stopped"
+)
+
+// Restart delays: the delay doubles after each restart, and is reset
+// once the container has run long enough.
+const (
+	restartDelayMin   = 100 * time.Millisecond
+	restartDelayMax   = time.Minute
+	restartResetAfter = 10 * time.Second
+)
+
+// RestartPolicy tells whether the monitor restarts the container when it exits
+type RestartPolicy struct {
+	Name string `json:"name"`
+	// MaximumRetryCount limits on-failure restarts, 0 for no limit
+	MaximumRetryCount int `json:"maximum_retry_count,omitempty"`
+}
+
+// ParseRestartPolicy parses a restart policy: no, on-failure[:max-retries],
+// always or unless-stopped
+func ParseRestartPolicy(s string) (RestartPolicy, error) {
+	name, count, hasCount := strings.Cut(s, ":")
+	policy := RestartPolicy{Name: name}
+	switch name {
+	case "", RestartNo:
+		policy.Name = RestartNo
+	case RestartOnFailure, RestartAlways, RestartUnlessStopped:
+	default:
+		return policy, errors.Errorf("invalid restart policy %q", s)
+	}
+	if hasCount {
+		if name != RestartOnFailure {
+			return policy, errors.Errorf("invalid restart policy %q, only on-failure has a maximum retry count", s)
+		}
+		n, err := strconv.Atoi(count)
+		if err != nil || n < 0 {
+			return policy, errors.Errorf("invalid restart policy %q, maximum retry count must be a positive integer", s)
+		}
+		policy.MaximumRetryCount = n
+	}
+	return policy, nil
+}
+
+// shouldRestart reports whether the container must be restarted after it
+// exited, unless it was stopped
+func (p RestartPolicy) shouldRestart(exitCode, restartCount int) bool {
+	switch p.Name {
+	case RestartAlways, RestartUnlessStopped:
+		return true
+	case RestartOnFailure:
+		return exitCode != 0 && (p.MaximumRetryCount == 0 || restartCount < p.MaximumRetryCount)
+	}
+	return false
+}
+
+// restartOnBoot reports whether the container must be started again
+// after its monitor is gone, by `container start --all-restartable`
+func (p RestartPolicy) restartOnBoot(state *State) bool {
+	return p.Name == RestartAlways || (p.Name == RestartUnlessStopped && !state.ManuallyStopped)
+}
+
+// validateRestartPolicy checks the restart policy can be applied, there
+// is no monitor to restart a foreground container
+func (hc *HostConfig) validateRestartPolicy() error {
+	if hc.RestartPolicy.Name != "" && hc.RestartPolicy.Name != RestartNo && !hc.Detach {
+		return errors.New("restart policies require a detached container (--detach)")
+	}
+	return nil
+}
+
+// nextRestartDelay returns the delay before restarting a container which
+// ran for the given duration, after the previous delay
+func nextRestartDelay(delay, ran time.Duration) time.Duration {
+	if delay == 0 || ran >= restartResetAfter {
+		return restartDelayMin
+	}
+	delay *= 2
+	if delay > restartDelayMax {
+		delay = restartDelayMax
+	}
+	return delay
+}
@@ -0,0 +1,127 @@
+package containers
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/pkg/errors"
+
+	"github.com/ntk148v/koker/pkg/constants"
+	"github.com/ntk148v/koker/pkg/images"
+	"github.com/ntk148v/koker/pkg/utils"
+)
+
+// defaultPath is the PATH of containers which aren't run from an image
+const defaultPath = "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// prepareRootFS creates the container's directory, writes its config and
+// returns the layers of its root filesystem. The root filesystem is either
+// pulled from a registry, or a plain directory or tarball on the host.
+func (c *Container) prepareRootFS() ([]string, error) {
+	if err := c.prepareDir(); err != nil {
+		return nil, err
+	}
+
+	hc := c.HostConfig
+	if hc.RootFSTar != "" {
+		if err := c.extractRootFS(); err != nil {
+			return nil, err
+		}
+	}
+
+	if rootfs := c.rootFSDir(); rootfs != "" {
+		info, err := os.Stat(rootfs)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			return nil, errors.Errorf("root filesystem %s is not a directory", rootfs)
+		}
+		if err := c.writeDefaultConfig(); err != nil {
+			return nil, errors.Wrap(err, "unable to write container config")
+		}
+		return c.rootFSLayers()
+	}
+
+	// Get image
+	img, err := images.NewImage(hc.Image)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to get image")
+	}
+	if err := c.copyImageConfig(img); err != nil {
+		return nil, errors.Wrap(err, "unable to copy image config")
+	}
+	return c.imageLayers(img), nil
+}
+
+// rootFSDir returns the root filesystem directory of a container which
+// isn't run from an image: the --rootfs one, or where its --rootfs-tar
+// tarball is extracted.
+func (c *Container) rootFSDir() string {
+	if c.HostConfig.RootFSTar != "" {
+		return filepath.Join(constants.KokerContainersPath, c.ID, "rootfs")
+	}
+	return c.HostConfig.RootFSPath
+}
+
+// extractRootFS extracts the root filesystem tarball, once: the
+// container runs again from the extracted directory.
+func (c *Container) extractRootFS() error {
+	rootfs := c.rootFSDir()
+	if _, err := os.Stat(rootfs); err == nil {
+		return nil
+	}
+	c.log.Info().Str("tarball", c.HostConfig.RootFSTar).Msg("Extract root filesystem tarball")
+	// Extracted aside, so that a failed extraction is done again
+	tmp := rootfs + ".tmp"
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+	if err := utils.CreateDir(tmp); err != nil {
+		return err
+	}
+	if err := utils.Extract(c.HostConfig.RootFSTar, tmp); err != nil {
+		return errors.Wrapf(err, "unable to extract %s", c.HostConfig.RootFSTar)
+	}
+	return os.Rename(tmp, rootfs)
+}
+
+// rootFSLayers returns the layers of the container's root filesystem:
+// the root filesystem directory is the only layer, otherwise the
+// extracted image layers.
+func (c *Container) rootFSLayers() ([]string, error) {
+	if rootfs := c.rootFSDir(); rootfs != "" {
+		rootfs, err := filepath.Abs(rootfs)
+		if err != nil {
+			return nil, err
+		}
+		return []string{rootfs}, nil
+	}
+
+	img, err := images.NewImage(c.HostConfig.Image)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to get image")
+	}
+	return c.imageLayers(img), nil
+}
+
+// writeDefaultConfig writes the config of a container without image:
+// run a shell with the default PATH.
+func (c *Container) writeDefaultConfig() error {
+	c.log.Debug().Msg("Write default container config")
+	configFile := v1.ConfigFile{
+		OS: "linux",
+		Config: v1.Config{
+			Cmd: []string{"/bin/sh"},
+			Env: []string{defaultPath},
+		},
+	}
+	b, err := json.Marshal(configFile)
+	if err != nil {
+		return err
+	}
+	conCfg := filepath.Join(constants.KokerContainersPath, c.ID, "config.json")
+	return os.WriteFile(conCfg, b, 0644)
+}
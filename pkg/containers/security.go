@@ -0,0 +1,126 @@
+package containers
+
+import (
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+
+	"github.com/ntk148v/koker/pkg/landlock"
+)
+
+// threadNamespaces are the namespaces a thread may have changed, by
+// their /proc/thread-self/ns name. A time namespace can't be joined by
+// a thread of a multithreaded process, it is created again instead.
+var threadNamespaces = map[int]string{
+	unix.CLONE_NEWNET:    "net",
+	unix.CLONE_NEWUTS:    "uts",
+	unix.CLONE_NEWIPC:    "ipc",
+	unix.CLONE_NEWPID:    "pid_for_children",
+	unix.CLONE_NEWCGROUP: "cgroup",
+}
+
+// ParseSecurityOpts parses the security options in key=value format,
+// landlock=<profile> is the only one supported.
+func (hc *HostConfig) ParseSecurityOpts(ss []string) error {
+	for _, s := range ss {
+		key, value, ok := strings.Cut(s, "=")
+		if !ok || value == "" {
+			return errors.Errorf("invalid security option %q, expected key=value", s)
+		}
+		switch key {
+		case "landlock":
+			profile, err := landlock.LoadProfile(value)
+			if err != nil {
+				return err
+			}
+			hc.Landlock = profile
+		default:
+			return errors.Errorf("unknown security option %q", key)
+		}
+	}
+	return nil
+}
+
+// landlockABI returns the Landlock ABI version the container's profile
+// is enforced with, 0 if there is none or the kernel doesn't support it
+func (c *Container) landlockABI() int {
+	if c.HostConfig.Landlock == nil {
+		return 0
+	}
+	abi := landlock.ABI()
+	if abi == 0 {
+		c.log.Warn().Msg("Landlock isn't supported by the kernel, skip the landlock profile")
+	}
+	return abi
+}
+
+// openThreadNamespaces opens the namespaces of the calling thread
+func openThreadNamespaces() (map[int]*os.File, error) {
+	namespaces := make(map[int]*os.File)
+	for flag, name := range threadNamespaces {
+		f, err := os.Open("/proc/thread-self/ns/" + name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			closeNamespaces(namespaces)
+			return nil, errors.Wrapf(err, "unable to open %s namespace", name)
+		}
+		namespaces[flag] = f
+	}
+	return namespaces, nil
+}
+
+// closeNamespaces closes namespaces opened by openThreadNamespaces
+func closeNamespaces(namespaces map[int]*os.File) {
+	for _, f := range namespaces {
+		f.Close()
+	}
+}
+
+// restrictThread restricts the calling thread by the container's
+// Landlock profile, whose rules paths are relative to the current root
+func (c *Container) restrictThread(abi int) error {
+	c.log.Info().Int("abi", abi).Msg("Restrict command with landlock profile")
+	ruleset, err := c.HostConfig.Landlock.Ruleset(abi)
+	if err != nil {
+		return err
+	}
+	defer ruleset.Close()
+	return landlock.RestrictSelf(ruleset)
+}
+
+// startRestricted starts the command from a thread restricted by the
+// container's Landlock profile, whose rules paths are relative to the
+// current root. A restricted thread can't unmount anything: it is
+// discarded once the command is started, after joining the given
+// namespaces and creating the time namespace if timens is set.
+func (c *Container) startRestricted(cmd *exec.Cmd, abi int, namespaces map[int]*os.File, timens bool) error {
+	errc := make(chan error, 1)
+	go func() {
+		// Never unlocked, the thread terminates with the goroutine
+		runtime.LockOSThread()
+		for flag, f := range namespaces {
+			if err := unix.Setns(int(f.Fd()), flag); err != nil {
+				errc <- errors.Wrapf(err, "can't setns to %s namespace", threadNamespaces[flag])
+				return
+			}
+		}
+		if timens {
+			if err := c.unshareTimens(); err != nil {
+				errc <- err
+				return
+			}
+		}
+		if err := c.restrictThread(abi); err != nil {
+			errc <- err
+			return
+		}
+		errc <- cmd.Start()
+	}()
+	return <-errc
+}
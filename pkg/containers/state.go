@@ -0,0 +1,134 @@
+package containers
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/ntk148v/koker/pkg/constants"
+)
+
+// Container statuses
+const (
+	StatusCreated    = "created"
+	StatusRunning    = "running"
+	StatusRestarting = "restarting"
+	StatusExited     = "exited"
+	// StatusPaused isn't saved, a running container is paused while its
+	// cgroups are frozen
+	StatusPaused = "paused"
+)
+
+// State is the runtime state of a container, as opposed to its config.
+// It is written by the process supervising the container, the monitor.
+type State struct {
+	Status string `json:"status"`
+	// Pid of the container's child, MonitorPid of its supervising process
+	Pid        int `json:"pid,omitempty"`
+	MonitorPid int `json:"monitor_pid,omitempty"`
+	// Exit status and reason of the last run
+	ExitCode     int       `json:"exit_code"`
+	ExitReason   string    `json:"exit_reason,omitempty"`
+	OOMKilled    bool      `json:"oom_killed"`
+	RestartCount int       `json:"restart_count"`
+	StartedAt    time.Time `json:"started_at,omitempty"`
+	FinishedAt   time.Time `json:"finished_at,omitempty"`
+	// ManuallyStopped is set by `container stop`, unless-stopped
+	// containers aren't restarted then
+	ManuallyStopped bool    `json:"manually_stopped,omitempty"`
+	Health          *Health `json:"health,omitempty"`
+	// Network is set while a bridge network container is running
+	Network *NetworkSettings `json:"network,omitempty"`
+	// ResourceUsage is recorded when the container exits
+	ResourceUsage *ResourceUsage `json:"resource_usage,omitempty"`
+}
+
+// running reports whether the container is running, or about to. The
+// state may be stale if its monitor is gone, after a reboot for instance.
+func (s *State) running() bool {
+	switch s.Status {
+	case StatusCreated, StatusRunning, StatusRestarting:
+		return s.MonitorPid > 0 && syscall.Kill(s.MonitorPid, 0) == nil
+	}
+	return false
+}
+
+// status returns the container's status, exited if its state is stale
+func (s *State) status() string {
+	if s.Status == "" {
+		return StatusCreated
+	}
+	if s.Status != StatusExited && s.MonitorPid > 0 && !s.running() {
+		return StatusExited
+	}
+	return s.Status
+}
+
+// statePath returns the path of the container's state file
+func (c *Container) statePath() string {
+	return filepath.Join(constants.KokerContainersPath, c.ID, "state.json")
+}
+
+// saveState writes the container's state file. It is replaced rather
+// than rewritten, readers never see a partial state.
+func (c *Container) saveState(state *State) error {
+	b, err := json.Marshal(state)
+	if err != nil {
+		return errors.Wrap(err, "unable to marshal container state")
+	}
+	tmp := c.statePath() + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.statePath())
+}
+
+// loadState reads the container's state file, a container without
+// state file has an empty state
+func (c *Container) loadState() (*State, error) {
+	state := new(State)
+	data, err := os.ReadFile(c.statePath())
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, errors.Wrap(err, "unable to unmarshal container state")
+	}
+	return state, nil
+}
+
+// updateState applies update to the container's state and saves it. The
+// monitor keeps the state in memory, it is updated from several goroutines.
+func (c *Container) updateState(update func(*State)) {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	if c.state == nil {
+		state, err := c.loadState()
+		if err != nil {
+			c.log.Warn().Err(err).Msg("Unable to load container state, reset it")
+			state = new(State)
+		}
+		c.state = state
+	}
+	update(c.state)
+	if err := c.saveState(c.state); err != nil {
+		c.log.Error().Err(err).Msg("Save container state failed")
+	}
+}
+
+// ExitStatus returns the exit status of a command like a shell does:
+// 128 plus the signal number if it was killed by a signal
+func ExitStatus(err *exec.ExitError) int {
+	if ws, ok := err.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return 128 + int(ws.Signal())
+	}
+	return err.ExitCode()
+}
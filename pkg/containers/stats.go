@@ -0,0 +1,146 @@
+package containers
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+
+	"github.com/ntk148v/koker/pkg/cgroups"
+	"github.com/ntk148v/koker/pkg/network"
+	"github.com/ntk148v/koker/pkg/utils"
+)
+
+// Stats are the resource usage statistics of a running container
+type Stats struct {
+	ID   string    `json:"id"`
+	Read time.Time `json:"read"`
+	*cgroups.Stats
+	// Bytes received and transmitted by the container, on the bridge network
+	NetRx uint64 `json:"net_rx"`
+	NetTx uint64 `json:"net_tx"`
+}
+
+// Stats returns the container's resource usage from its cgroups and veth
+func (c *Container) Stats() (*Stats, error) {
+	state, err := c.loadState()
+	if err != nil {
+		return nil, err
+	}
+	if !state.running() {
+		return nil, errors.Errorf("container %s is not running", c.ID)
+	}
+
+	stats := &Stats{ID: c.ID, Read: time.Now()}
+	if stats.Stats, err = c.cg.Stats(); err != nil {
+		return nil, errors.Wrap(err, "unable to read cgroup statistics")
+	}
+	if state.Network != nil {
+		// The host end receives what the container transmits
+		tx, rx, err := network.LinkStatistics(state.Network.HostVeth)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to read network statistics")
+		}
+		stats.NetRx, stats.NetTx = rx, tx
+	}
+	return stats, nil
+}
+
+// statsInterval is the refresh interval of `container stats`
+const statsInterval = time.Second
+
+// WatchStats renders the statistics of the given containers, or of all the
+// running ones, every statsInterval. The first rendering waits for a
+// second sample, to compute the CPU usage. Unless stream is set, there is
+// only one.
+func WatchStats(ids []string, stream bool, render func([]map[string]string) error) error {
+	previous := make(map[string]*Stats)
+	for first := true; ; first = false {
+		watched := ids
+		if len(ids) == 0 {
+			running, err := ListAllContainers(false)
+			if err != nil {
+				return err
+			}
+			watched = nil
+			for _, container := range running {
+				watched = append(watched, container["id"])
+			}
+		}
+
+		rows := make([]map[string]string, 0, len(watched))
+		for _, id := range watched {
+			c, err := NewContainer(id)
+			if err != nil {
+				return err
+			}
+			stats, err := c.Stats()
+			if err != nil {
+				// Listed containers may stop meanwhile
+				if len(ids) == 0 {
+					continue
+				}
+				return err
+			}
+			rows = append(rows, FormatStats(stats, previous[id]))
+			previous[id] = stats
+		}
+
+		if !first {
+			if err := render(rows); err != nil {
+				return err
+			}
+			if !stream {
+				return nil
+			}
+		}
+		time.Sleep(statsInterval)
+	}
+}
+
+// FormatStats returns the `container stats` row of the statistics. The
+// CPU usage is computed since the previous statistics, if any.
+func FormatStats(stats, previous *Stats) map[string]string {
+	var cpuPercent float64
+	if previous != nil && stats.CPU.Usage >= previous.CPU.Usage {
+		if elapsed := stats.Read.Sub(previous.Read); elapsed > 0 {
+			cpuPercent = float64(stats.CPU.Usage-previous.CPU.Usage) / float64(elapsed) * 100
+		}
+	}
+
+	// The page cache can be reclaimed, it isn't counted as used
+	mem := stats.Memory
+	usage := mem.Usage
+	if mem.Cache < usage {
+		usage -= mem.Cache
+	}
+	limit := mem.Limit
+	if limit == 0 {
+		limit = hostMemory()
+	}
+	var memPercent float64
+	if limit > 0 {
+		memPercent = float64(usage) / float64(limit) * 100
+	}
+
+	return map[string]string{
+		"id":    stats.ID,
+		"cpu":   fmt.Sprintf("%.2f%%", cpuPercent),
+		"mem":   fmt.Sprintf("%s / %s", utils.HumanSize(usage), utils.HumanSize(limit)),
+		"memp":  fmt.Sprintf("%.2f%%", memPercent),
+		"net":   fmt.Sprintf("%s / %s", utils.HumanSize(stats.NetRx), utils.HumanSize(stats.NetTx)),
+		"block": fmt.Sprintf("%s / %s", utils.HumanSize(stats.IO.ReadBytes), utils.HumanSize(stats.IO.WriteBytes)),
+		"pids":  fmt.Sprintf("%d", stats.Pids.Current),
+	}
+}
+
+// hostMemory returns the host's total memory, the memory limit of
+// containers without one
+func hostMemory() uint64 {
+	var info unix.Sysinfo_t
+	if err := unix.Sysinfo(&info); err != nil {
+		return 0
+	}
+	return uint64(info.Totalram) * uint64(info.Unit)
+}
@@ -0,0 +1,80 @@
+package containers
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// namespacedSysctls are the sysctls of the IPC namespace,
+// see ipc_namespaces(7). net.* and fs.mqueue.* ones are
+// checked by prefix.
+var namespacedSysctls = map[string]bool{
+	"kernel.msgmax":          true,
+	"kernel.msgmnb":          true,
+	"kernel.msgmni":          true,
+	"kernel.sem":             true,
+	"kernel.shmall":          true,
+	"kernel.shmmax":          true,
+	"kernel.shmmni":          true,
+	"kernel.shm_rmid_forced": true,
+}
+
+// ParseSysctls parses sysctls in key=value format. Keys may use
+// dots or slashes as separators.
+func ParseSysctls(ss []string) (map[string]string, error) {
+	sysctls := make(map[string]string)
+	for _, s := range ss {
+		key, value, ok := strings.Cut(s, "=")
+		if !ok || key == "" {
+			return nil, errors.Errorf("invalid sysctl %q, expected key=value", s)
+		}
+		sysctls[strings.ReplaceAll(key, "/", ".")] = value
+	}
+	return sysctls, nil
+}
+
+// ValidateSysctl checks that a sysctl only affects the container's
+// namespaces: setting a host-global one would change the host.
+func ValidateSysctl(key string) error {
+	switch {
+	case namespacedSysctls[key],
+		strings.HasPrefix(key, "fs.mqueue."),
+		strings.HasPrefix(key, "net."):
+		return nil
+	}
+	return errors.Errorf("sysctl %q is not namespaced, it can't be set for a container", key)
+}
+
+// validateSysctls checks the container's sysctls. They can't be set
+// in a namespace shared with the host or another container.
+func (hc *HostConfig) validateSysctls() error {
+	for key := range hc.Sysctls {
+		if err := ValidateSysctl(key); err != nil {
+			return err
+		}
+		if strings.HasPrefix(key, "net.") {
+			if !hc.privateNetwork() {
+				return errors.Errorf("sysctl %q can't be set in a shared network namespace", key)
+			}
+		} else if hc.IpcMode != "" {
+			return errors.Errorf("sysctl %q can't be set in a shared IPC namespace", key)
+		}
+	}
+	return nil
+}
+
+// setSysctls writes the container's sysctls to /proc/sys. It must run
+// in the container's IPC and network namespaces, with its /proc mounted.
+func (c *Container) setSysctls() error {
+	for key, value := range c.HostConfig.Sysctls {
+		c.log.Debug().Str("key", key).Str("value", value).Msg("Set container's sysctl")
+		file := filepath.Join("/proc/sys", strings.ReplaceAll(key, ".", "/"))
+		if err := os.WriteFile(file, []byte(value), 0644); err != nil {
+			return errors.Wrapf(err, "unable to set sysctl %s", key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package containers
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// timeNamespaceClocks are the clocks which can be offset in a time namespace
+var timeNamespaceClocks = map[string]bool{
+	"monotonic": true,
+	"boottime":  true,
+}
+
+// ParseTimeOffsets parses clock offsets in clock=offset format, the offset
+// being a signed duration such as +3600s or -1h30m.
+func ParseTimeOffsets(ss []string) (map[string]time.Duration, error) {
+	if len(ss) == 0 {
+		return nil, nil
+	}
+	offsets := make(map[string]time.Duration)
+	for _, s := range ss {
+		clock, value, ok := strings.Cut(s, "=")
+		if !ok || !timeNamespaceClocks[clock] {
+			return nil, errors.Errorf("invalid time offset %q, expected monotonic=<offset> or boottime=<offset>", s)
+		}
+		offset, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid time offset %q", s)
+		}
+		offsets[clock] = offset
+	}
+	return offsets, nil
+}
+
+// checkTimens checks that the kernel supports time namespaces
+func checkTimens() error {
+	if _, err := os.Stat("/proc/self/ns/time"); os.IsNotExist(err) {
+		return errors.New("time namespaces aren't supported by the kernel, Linux 5.6 or later is required")
+	}
+	return nil
+}
+
+// unshareTimens creates a time namespace with the container's clock
+// offsets, for the children of the calling thread. The offsets can only
+// be written until a process enters the namespace: the calling thread
+// must fork the workload.
+func (c *Container) unshareTimens() error {
+	c.log.Info().Msg("Unshare time namespace")
+	if err := unix.Unshare(unix.CLONE_NEWTIME); err != nil {
+		return errors.Wrap(err, "unable to unshare time namespace")
+	}
+
+	var offsets strings.Builder
+	for clock, offset := range c.HostConfig.TimeOffsets {
+		c.log.Debug().Str("clock", clock).Dur("offset", offset).Msg("Set clock offset")
+		// As a timespec, nanoseconds are always positive
+		secs, nsecs := offset/time.Second, offset%time.Second
+		if nsecs < 0 {
+			secs, nsecs = secs-1, nsecs+time.Second
+		}
+		fmt.Fprintf(&offsets, "%s %d %d\n", clock, secs, nsecs)
+	}
+	// Only available per process, but /proc/<tid> is the calling thread's.
+	// thread-self links to <pid>/task/<tid> in the pid namespace of /proc.
+	self, err := os.Readlink("/proc/thread-self")
+	if err != nil {
+		return errors.Wrap(err, "unable to find thread id")
+	}
+	path := filepath.Join("/proc", filepath.Base(self), "timens_offsets")
+	if err := os.WriteFile(path, []byte(offsets.String()), 0644); err != nil {
+		return errors.Wrap(err, "unable to set clock offsets")
+	}
+	return nil
+}
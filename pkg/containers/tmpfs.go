@@ -0,0 +1,184 @@
+package containers
+
+import (
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+
+	"github.com/ntk148v/koker/pkg/filesystem"
+)
+
+// tmpfsFlags maps tmpfs mount flags to whether they are set or cleared
+var tmpfsFlags = map[string]struct {
+	clear bool
+	flag  uintptr
+}{
+	"ro":       {false, syscall.MS_RDONLY},
+	"rw":       {true, syscall.MS_RDONLY},
+	"noexec":   {false, syscall.MS_NOEXEC},
+	"exec":     {true, syscall.MS_NOEXEC},
+	"nosuid":   {false, syscall.MS_NOSUID},
+	"suid":     {true, syscall.MS_NOSUID},
+	"nodev":    {false, syscall.MS_NODEV},
+	"dev":      {true, syscall.MS_NODEV},
+	"noatime":  {false, syscall.MS_NOATIME},
+	"atime":    {true, syscall.MS_NOATIME},
+	"relatime": {false, syscall.MS_RELATIME},
+}
+
+// tmpfsSizeRe matches tmpfs sizes: bytes, with a k, m or g suffix
+var tmpfsSizeRe = regexp.MustCompile(`^([0-9]+)([kKmMgG]?)$`)
+
+// Tmpfs is a tmpfs mount of the container
+type Tmpfs struct {
+	Target string `json:"target"`
+	// Size in bytes, 0 is the kernel default: half of the RAM
+	Size    int64    `json:"size,omitempty"`
+	Options []string `json:"options,omitempty"`
+}
+
+// ParseTmpfs parses a tmpfs mount in path[:options] format, options
+// being comma separated tmpfs options: size, nr_inodes, mode, uid, gid,
+// and mount flags such as ro, noexec, nosuid or nodev.
+func ParseTmpfs(s string) (Tmpfs, error) {
+	var t Tmpfs
+	target, opts, _ := strings.Cut(s, ":")
+	if !path.IsAbs(target) {
+		return t, errors.Errorf("invalid tmpfs %q, path must be absolute", s)
+	}
+	t.Target = path.Clean(target)
+	if t.Target == "/" {
+		return t, errors.Errorf("invalid tmpfs %q, can't mount over /", s)
+	}
+	if opts == "" {
+		return t, nil
+	}
+
+	for _, opt := range strings.Split(opts, ",") {
+		key, value, hasValue := strings.Cut(opt, "=")
+		if _, ok := tmpfsFlags[key]; ok && !hasValue {
+			t.Options = append(t.Options, key)
+			continue
+		}
+		if !hasValue || value == "" {
+			return t, errors.Errorf("invalid tmpfs %q, unknown option %q", s, opt)
+		}
+
+		switch key {
+		case "size":
+			size, err := parseTmpfsSize(value)
+			if err != nil {
+				return t, errors.Wrapf(err, "invalid tmpfs %q", s)
+			}
+			t.Size = size
+			continue
+		case "nr_inodes":
+			if !tmpfsSizeRe.MatchString(value) {
+				return t, errors.Errorf("invalid tmpfs %q, invalid nr_inodes %q", s, value)
+			}
+		case "mode":
+			if _, err := strconv.ParseUint(value, 8, 32); err != nil {
+				return t, errors.Errorf("invalid tmpfs %q, mode must be octal", s)
+			}
+		case "uid", "gid":
+			if _, err := strconv.ParseUint(value, 10, 32); err != nil {
+				return t, errors.Errorf("invalid tmpfs %q, invalid %s %q", s, key, value)
+			}
+		default:
+			return t, errors.Errorf("invalid tmpfs %q, unknown option %q", s, opt)
+		}
+		t.Options = append(t.Options, opt)
+	}
+	return t, nil
+}
+
+// ParseTmpfsMounts parses a list of tmpfs mounts
+func ParseTmpfsMounts(ss []string) ([]Tmpfs, error) {
+	var mounts []Tmpfs
+	targets := make(map[string]bool)
+	for _, s := range ss {
+		t, err := ParseTmpfs(s)
+		if err != nil {
+			return nil, err
+		}
+		if targets[t.Target] {
+			return nil, errors.Errorf("duplicate tmpfs mount %s", t.Target)
+		}
+		targets[t.Target] = true
+		mounts = append(mounts, t)
+	}
+	return mounts, nil
+}
+
+// parseTmpfsSize returns a size in bytes
+func parseTmpfsSize(s string) (int64, error) {
+	m := tmpfsSizeRe.FindStringSubmatch(s)
+	if m == nil {
+		return 0, errors.Errorf("invalid size %q", s)
+	}
+	size, err := strconv.ParseInt(m[1], 10, 64)
+	if err != nil {
+		return 0, errors.Errorf("invalid size %q", s)
+	}
+	switch strings.ToLower(m[2]) {
+	case "k":
+		size <<= 10
+	case "m":
+		size <<= 20
+	case "g":
+		size <<= 30
+	}
+	return size, nil
+}
+
+// MountOption returns the mount option of the tmpfs mount
+func (t Tmpfs) MountOption() filesystem.MountOption {
+	var (
+		flag uintptr
+		data []string
+	)
+	for _, opt := range t.Options {
+		if f, ok := tmpfsFlags[opt]; ok {
+			if f.clear {
+				flag &^= f.flag
+			} else {
+				flag |= f.flag
+			}
+			continue
+		}
+		data = append(data, opt)
+	}
+	if t.Size > 0 {
+		data = append(data, "size="+strconv.FormatInt(t.Size, 10))
+	}
+	return filesystem.MountOption{
+		Source: "tmpfs",
+		Target: t.Target,
+		Type:   "tmpfs",
+		Flag:   flag,
+		Option: strings.Join(data, ","),
+	}
+}
+
+// validateTmpfs checks tmpfs sizes against the memory limit. Tmpfs pages
+// are charged to the memory cgroup of the process writing them, so
+// tmpfs mounts larger than the container memory could never be filled.
+func (hc *HostConfig) validateTmpfs() error {
+	if hc.Memory <= 0 {
+		return nil
+	}
+	var total int64
+	memory := int64(hc.Memory)
+	for _, t := range hc.Tmpfs {
+		total += t.Size
+	}
+	if total > memory {
+		return errors.Errorf("tmpfs sizes (%d bytes) exceed the container memory limit (%d bytes)",
+			total, memory)
+	}
+	return nil
+}
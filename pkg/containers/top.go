@@ -0,0 +1,256 @@
+package containers
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// clockTicks is the USER_HZ unit of the CPU times in /proc/<pid>/stat,
+// 100 on all the architectures Linux supports
+const clockTicks = 100
+
+// process is a process of the container, as read from /proc
+type process struct {
+	pid, ppid int
+	// nspid is the pid in the container's pid namespace
+	nspid   int
+	uid     string
+	cpuTime time.Duration
+	// rss in kB
+	rss int
+	cmd string
+}
+
+// Top returns the processes running in the container's cgroup. With
+// tree, children follow their parent and their command is indented.
+func (c *Container) Top(tree bool) ([]map[string]string, error) {
+	procs, err := c.processes()
+	if err != nil {
+		return nil, err
+	}
+	depths := make(map[int]int, len(procs))
+	if tree {
+		procs, depths = processTree(procs)
+	}
+
+	top := make([]map[string]string, 0, len(procs))
+	for _, p := range procs {
+		cmd := p.cmd
+		if depth := depths[p.pid]; depth > 0 {
+			cmd = strings.Repeat("    ", depth-1) + " \\_ " + cmd
+		}
+		top = append(top, map[string]string{
+			"pid":   strconv.Itoa(p.pid),
+			"nspid": strconv.Itoa(p.nspid),
+			"user":  userName(p.uid),
+			"time":  formatCPUTime(p.cpuTime),
+			"rss":   strconv.Itoa(p.rss),
+			"cmd":   cmd,
+		})
+	}
+	return top, nil
+}
+
+// TopPs runs the host's ps with the given options, and only keeps the
+// lines of the container's processes, found by the PID column.
+func (c *Container) TopPs(psArgs []string) (string, error) {
+	pids, err := c.runningPids()
+	if err != nil {
+		return "", err
+	}
+	out, err := exec.Command("ps", psArgs...).Output()
+	if err != nil {
+		return "", errors.Wrap(err, "unable to run ps")
+	}
+
+	lines := strings.Split(strings.TrimRight(string(out), "\n"), "\n")
+	pidColumn := -1
+	for i, field := range strings.Fields(lines[0]) {
+		if field == "PID" {
+			pidColumn = i
+			break
+		}
+	}
+	if pidColumn < 0 {
+		return "", errors.New("no PID column in ps output, add it to the ps options")
+	}
+
+	var b strings.Builder
+	b.WriteString(lines[0] + "\n")
+	for _, line := range lines[1:] {
+		fields := strings.Fields(line)
+		if len(fields) <= pidColumn {
+			continue
+		}
+		if pid, err := strconv.Atoi(fields[pidColumn]); err == nil && pids[pid] {
+			b.WriteString(line + "\n")
+		}
+	}
+	return b.String(), nil
+}
+
+// runningPids returns the pids of the container's cgroup, it must be running
+func (c *Container) runningPids() (map[int]bool, error) {
+	state, err := c.loadState()
+	if err != nil {
+		return nil, err
+	}
+	if !state.running() {
+		return nil, errors.Errorf("container %s is not running", c.ID)
+	}
+	cgPids, err := c.cg.GetPids()
+	if err != nil {
+		return nil, err
+	}
+	pids := make(map[int]bool, len(cgPids))
+	for _, pid := range cgPids {
+		if pid, err := strconv.Atoi(pid); err == nil {
+			pids[pid] = true
+		}
+	}
+	return pids, nil
+}
+
+// processes reads the container's processes from /proc, sorted by pid.
+// Processes exiting meanwhile are skipped.
+func (c *Container) processes() ([]process, error) {
+	pids, err := c.runningPids()
+	if err != nil {
+		return nil, err
+	}
+	procs := make([]process, 0, len(pids))
+	for pid := range pids {
+		p, err := readProcess(pid)
+		if err != nil {
+			continue
+		}
+		procs = append(procs, p)
+	}
+	sort.Slice(procs, func(i, j int) bool { return procs[i].pid < procs[j].pid })
+	return procs, nil
+}
+
+// readProcess reads a process from /proc/<pid>/status, stat and cmdline
+func readProcess(pid int) (process, error) {
+	p := process{pid: pid, nspid: pid}
+	dir := filepath.Join("/proc", strconv.Itoa(pid))
+	status, err := os.Open(filepath.Join(dir, "status"))
+	if err != nil {
+		return p, err
+	}
+	defer status.Close()
+
+	var name string
+	scanner := bufio.NewScanner(status)
+	for scanner.Scan() {
+		key, value, _ := strings.Cut(scanner.Text(), ":")
+		fields := strings.Fields(value)
+		if len(fields) == 0 {
+			continue
+		}
+		switch key {
+		case "Name":
+			name = fields[0]
+		case "PPid":
+			p.ppid, _ = strconv.Atoi(fields[0])
+		case "Uid":
+			p.uid = fields[0]
+		case "NSpid":
+			// The last pid is the one in the innermost pid namespace
+			p.nspid, _ = strconv.Atoi(fields[len(fields)-1])
+		case "VmRSS":
+			p.rss, _ = strconv.Atoi(fields[0])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return p, err
+	}
+
+	stat, err := os.ReadFile(filepath.Join(dir, "stat"))
+	if err != nil {
+		return p, err
+	}
+	// The command name may contain spaces, fields start after it
+	if i := bytes.LastIndexByte(stat, ')'); i > 0 {
+		fields := strings.Fields(string(stat[i+1:]))
+		// utime and stime, fields 14 and 15 of stat
+		if len(fields) > 12 {
+			utime, _ := strconv.Atoi(fields[11])
+			stime, _ := strconv.Atoi(fields[12])
+			p.cpuTime = time.Duration(utime+stime) * time.Second / clockTicks
+		}
+	}
+
+	cmdline, err := os.ReadFile(filepath.Join(dir, "cmdline"))
+	if err != nil {
+		return p, err
+	}
+	p.cmd = string(bytes.TrimSpace(bytes.ReplaceAll(cmdline, []byte{0}, []byte{' '})))
+	if p.cmd == "" {
+		// Kernel threads and zombies have no command line
+		p.cmd = "[" + name + "]"
+	}
+	return p, nil
+}
+
+// processTree orders processes depth first, children after their parent,
+// and returns their depth in the tree. Processes whose parent isn't in
+// the container are roots.
+func processTree(procs []process) ([]process, map[int]int) {
+	inContainer := make(map[int]bool, len(procs))
+	for _, p := range procs {
+		inContainer[p.pid] = true
+	}
+	children := make(map[int][]process)
+	var roots []process
+	for _, p := range procs {
+		if inContainer[p.ppid] {
+			children[p.ppid] = append(children[p.ppid], p)
+		} else {
+			roots = append(roots, p)
+		}
+	}
+
+	ordered := make([]process, 0, len(procs))
+	depths := make(map[int]int, len(procs))
+	var walk func(p process, depth int)
+	walk = func(p process, depth int) {
+		ordered = append(ordered, p)
+		depths[p.pid] = depth
+		for _, child := range children[p.pid] {
+			walk(child, depth+1)
+		}
+	}
+	for _, root := range roots {
+		walk(root, 0)
+	}
+	return ordered, depths
+}
+
+// userName returns the host user name of uid, uid itself if unknown
+func userName(uid string) string {
+	if u, err := user.LookupId(uid); err == nil {
+		return u.Username
+	}
+	return uid
+}
+
+// formatCPUTime formats a CPU time like ps does: [DD-]HH:MM:SS
+func formatCPUTime(d time.Duration) string {
+	s := int(d.Seconds())
+	if days := s / 86400; days > 0 {
+		return fmt.Sprintf("%d-%02d:%02d:%02d", days, s/3600%24, s/60%60, s%60)
+	}
+	return fmt.Sprintf("%02d:%02d:%02d", s/3600, s/60%60, s%60)
+}
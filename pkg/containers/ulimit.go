@@ -0,0 +1,149 @@
+package containers
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// ulimitResources maps ulimit names to resources
+var ulimitResources = map[string]int{
+	"as":         unix.RLIMIT_AS,
+	"core":       unix.RLIMIT_CORE,
+	"cpu":        unix.RLIMIT_CPU,
+	"data":       unix.RLIMIT_DATA,
+	"fsize":      unix.RLIMIT_FSIZE,
+	"locks":      unix.RLIMIT_LOCKS,
+	"memlock":    unix.RLIMIT_MEMLOCK,
+	"msgqueue":   unix.RLIMIT_MSGQUEUE,
+	"nice":       unix.RLIMIT_NICE,
+	"nofile":     unix.RLIMIT_NOFILE,
+	"nproc":      unix.RLIMIT_NPROC,
+	"rss":        unix.RLIMIT_RSS,
+	"rtprio":     unix.RLIMIT_RTPRIO,
+	"rttime":     unix.RLIMIT_RTTIME,
+	"sigpending": unix.RLIMIT_SIGPENDING,
+	"stack":      unix.RLIMIT_STACK,
+}
+
+// Ulimit is a resource limit of the container's processes.
+// -1 means unlimited.
+type Ulimit struct {
+	Name string `json:"name"`
+	Soft int64  `json:"soft"`
+	Hard int64  `json:"hard"`
+}
+
+func (u Ulimit) String() string {
+	return fmt.Sprintf("%s=%d:%d", u.Name, u.Soft, u.Hard)
+}
+
+// ParseUlimit parses a ulimit in name=soft[:hard] format. The hard limit
+// defaults to the soft one, and both accept "unlimited" or -1.
+func ParseUlimit(s string) (Ulimit, error) {
+	var u Ulimit
+	name, limits, ok := strings.Cut(s, "=")
+	if !ok {
+		return u, errors.Errorf("invalid ulimit %q, expected name=soft[:hard]", s)
+	}
+	if _, ok := ulimitResources[name]; !ok {
+		return u, errors.Errorf("invalid ulimit %q, unknown resource %q", s, name)
+	}
+	u.Name = name
+
+	soft, hard, hasHard := strings.Cut(limits, ":")
+	var err error
+	if u.Soft, err = parseUlimitValue(soft); err != nil {
+		return u, errors.Wrapf(err, "invalid ulimit %q", s)
+	}
+	u.Hard = u.Soft
+	if hasHard {
+		if u.Hard, err = parseUlimitValue(hard); err != nil {
+			return u, errors.Wrapf(err, "invalid ulimit %q", s)
+		}
+	}
+	if u.Hard != -1 && (u.Soft == -1 || u.Soft > u.Hard) {
+		return u, errors.Errorf("invalid ulimit %q, soft limit must not exceed hard limit", s)
+	}
+	return u, nil
+}
+
+func parseUlimitValue(s string) (int64, error) {
+	if s == "unlimited" {
+		return -1, nil
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || v < -1 {
+		return 0, errors.Errorf("invalid limit %q", s)
+	}
+	return v, nil
+}
+
+// ParseUlimits parses a list of ulimits, the last one wins for
+// a resource given several times.
+func ParseUlimits(ss []string) ([]Ulimit, error) {
+	var ulimits []Ulimit
+	for _, s := range ss {
+		u, err := ParseUlimit(s)
+		if err != nil {
+			return nil, err
+		}
+		ulimits = MergeUlimits(ulimits, []Ulimit{u})
+	}
+	return ulimits, nil
+}
+
+// MergeUlimits returns defaults overridden by ulimits with the same name
+func MergeUlimits(defaults, ulimits []Ulimit) []Ulimit {
+	merged := make([]Ulimit, 0, len(defaults)+len(ulimits))
+	for _, d := range defaults {
+		overridden := false
+		for _, u := range ulimits {
+			if u.Name == d.Name {
+				overridden = true
+				break
+			}
+		}
+		if !overridden {
+			merged = append(merged, d)
+		}
+	}
+	return append(merged, ulimits...)
+}
+
+// setRlimits applies container's ulimits to the current process with
+// prlimit, so they are inherited by the command it executes.
+func (c *Container) setRlimits() error {
+	for _, u := range c.HostConfig.Ulimits {
+		c.log.Debug().Str("ulimit", u.String()).Msg("Set container's ulimit")
+		rlimit := &unix.Rlimit{Cur: rlimitValue(u.Soft), Max: rlimitValue(u.Hard)}
+		if err := unix.Prlimit(0, ulimitResources[u.Name], rlimit, nil); err != nil {
+			return errors.Wrapf(err, "unable to set ulimit %s", u)
+		}
+	}
+	return nil
+}
+
+func rlimitValue(v int64) uint64 {
+	if v < 0 {
+		return math.MaxUint64 // RLIM_INFINITY
+	}
+	return uint64(v)
+}
+
+// setOomScoreAdj writes the container's OOM score adjustment of the
+// current process, inherited by the command it executes.
+func (c *Container) setOomScoreAdj() error {
+	if c.HostConfig.OomScoreAdj == nil {
+		return nil
+	}
+	c.log.Debug().Int("oom_score_adj", *c.HostConfig.OomScoreAdj).
+		Msg("Set container's OOM score adjustment")
+	return os.WriteFile("/proc/self/oom_score_adj",
+		[]byte(strconv.Itoa(*c.HostConfig.OomScoreAdj)), 0644)
+}
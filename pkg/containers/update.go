@@ -0,0 +1,47 @@
+package containers
+
+import (
+	"github.com/pkg/errors"
+)
+
+// Update changes the container's resource limits with update. They are
+// saved for its next runs, and applied to its cgroups if it is running.
+func (c *Container) Update(update func(hc *HostConfig) error) error {
+	if err := c.loadHostConfig(); err != nil {
+		return err
+	}
+	state, err := c.loadState()
+	if err != nil {
+		return err
+	}
+	hc := c.HostConfig
+	if err := update(hc); err != nil {
+		return err
+	}
+	// Run records the hostname of a shared UTS namespace, which can't
+	// be set by the user
+	merged := *hc
+	if merged.UTSMode != "" {
+		merged.Hostname = ""
+	}
+	if err := merged.Validate(); err != nil {
+		return err
+	}
+
+	if state.running() {
+		stats, err := c.cg.Stats()
+		if err != nil {
+			return errors.Wrap(err, "unable to read container's memory usage")
+		}
+		// Without swap, the memory in use can't be reclaimed below the limit
+		if hc.Memory > 0 && hc.swapOff() && stats.Memory.Usage > uint64(hc.Memory) {
+			return errors.Errorf("memory limit %s is below the container's memory usage, %s, without swap",
+				hc.Memory, Bytes(stats.Memory.Usage))
+		}
+		c.log.Info().Msg("Update container's limit")
+		if err := c.setLimit(hc); err != nil {
+			return errors.Wrap(err, "unable to update container's limit")
+		}
+	}
+	return c.saveHostConfig()
+}
@@ -0,0 +1,113 @@
+package filesystem
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = whiteoutPrefix + whiteoutPrefix + ".opq"
+)
+
+// CopyMount is a fallback for OverlayMount when overlayfs can't be mounted,
+// e.g. in a user namespace on kernels older than 5.11. It copies the
+// layers into target, lowest first, applying the image whiteouts, and
+// returns a function to remove the copy.
+func CopyMount(target string, src []string) (Unmounter, error) {
+	unmounter := func() error {
+		log.Debug().Str("target", target).Msg("Remove copied layers")
+		return os.RemoveAll(target)
+	}
+
+	if err := os.MkdirAll(target, 0700); err != nil {
+		return unmounter, errors.Wrapf(err, "can't create %s directory", target)
+	}
+	// Overlay lowerdirs are ordered from top to bottom
+	for i := len(src) - 1; i >= 0; i-- {
+		log.Debug().Str("source", src[i]).Str("target", target).
+			Msg("Copy layer to target")
+		if err := copyLayer(src[i], target); err != nil {
+			return unmounter, errors.Wrapf(err, "unable to copy %s to %s", src[i], target)
+		}
+	}
+	return unmounter, nil
+}
+
+// copyLayer copies a layer directory on top of target
+func copyLayer(layer, target string) error {
+	return filepath.WalkDir(layer, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(layer, path)
+		if err != nil {
+			return err
+		}
+		dst := filepath.Join(target, rel)
+		name := d.Name()
+
+		if name == whiteoutOpaque {
+			// Handled with its directory
+			return nil
+		}
+		if strings.HasPrefix(name, whiteoutPrefix) {
+			return os.RemoveAll(filepath.Join(filepath.Dir(dst),
+				strings.TrimPrefix(name, whiteoutPrefix)))
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir():
+			if _, err := os.Lstat(filepath.Join(path, whiteoutOpaque)); err == nil {
+				// Opaque directory hides what the lower layers put in it
+				if err := os.RemoveAll(dst); err != nil {
+					return err
+				}
+			}
+			if err := os.MkdirAll(dst, info.Mode().Perm()); err != nil {
+				return err
+			}
+			return os.Chmod(dst, info.Mode().Perm())
+		case info.Mode()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			os.RemoveAll(dst)
+			return os.Symlink(link, dst)
+		case info.Mode().IsRegular():
+			os.RemoveAll(dst)
+			return copyRegular(path, dst, info.Mode().Perm())
+		default:
+			// Device nodes, fifos and sockets can't be created unprivileged
+			log.Debug().Str("path", path).Msg("Skip special file")
+			return nil
+		}
+	})
+}
+
+func copyRegular(src, dst string, perm fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, err = io.Copy(out, in)
+	return err
+}
@@ -8,6 +8,7 @@ import (
 
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
+	"golang.org/x/sys/unix"
 
 	"github.com/ntk148v/koker/pkg/utils"
 )
@@ -22,10 +23,12 @@ type MountOption struct {
 	Option string
 }
 
-// Mount mounts list of mountOptions and returns a function to unmount them.
+// Mount mounts list of mountOptions and returns a function to unmount them,
+// in reverse order so that nested mounts are unmounted first.
 func Mount(mountOpts ...MountOption) (Unmounter, error) {
 	unmounter := func() error {
-		for _, p := range mountOpts {
+		for i := len(mountOpts) - 1; i >= 0; i-- {
+			p := mountOpts[i]
 			log.Debug().Str("source", p.Source).Str("target", p.Target).
 				Msg("Unmount target")
 			if err := syscall.Unmount(p.Target, 0); err != nil {
@@ -47,9 +50,65 @@ func Mount(mountOpts ...MountOption) (Unmounter, error) {
 	return unmounter, nil
 }
 
-// OverlayMount mounts a list of source directories to a target
+// BindMount bind mounts source to target and returns a function to
+// unmount it. The bind mount is remounted read-only if ro is set.
+func BindMount(source, target string, ro bool) (Unmounter, error) {
+	unmounter := func() error {
+		log.Debug().Str("source", source).Str("target", target).
+			Msg("Unmount bind mount")
+		// Detach the submounts of the recursive bind mount as well
+		if err := syscall.Unmount(target, syscall.MNT_DETACH); err != nil {
+			return errors.Wrapf(err, "unable to umount %q", target)
+		}
+		return nil
+	}
+
+	log.Debug().Str("source", source).Str("target", target).Bool("ro", ro).
+		Msg("Bind mount source to target")
+	if err := syscall.Mount(source, target, "bind", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return unmounter, errors.Wrapf(err, "unable to bind mount %s to %s", source, target)
+	}
+	if !ro {
+		return unmounter, nil
+	}
+
+	// A bind mount can only be made read-only by remounting it, keeping
+	// the flags of the underlying mount which may be locked.
+	var st unix.Statfs_t
+	if err := unix.Statfs(target, &st); err != nil {
+		return unmounter, err
+	}
+	flag := uintptr(syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY)
+	for stFlag, msFlag := range map[int64]uintptr{
+		unix.ST_NOSUID:     syscall.MS_NOSUID,
+		unix.ST_NODEV:      syscall.MS_NODEV,
+		unix.ST_NOEXEC:     syscall.MS_NOEXEC,
+		unix.ST_NOATIME:    syscall.MS_NOATIME,
+		unix.ST_NODIRATIME: syscall.MS_NODIRATIME,
+		unix.ST_RELATIME:   syscall.MS_RELATIME,
+	} {
+		if int64(st.Flags)&stFlag != 0 {
+			flag |= msFlag
+		}
+	}
+	if err := syscall.Mount("", target, "", flag, ""); err != nil {
+		return unmounter, errors.Wrapf(err, "unable to remount %s read-only", target)
+	}
+	return unmounter, nil
+}
+
+// OverlayMount mounts a list of source directories to a target,
+// the first directory being the top layer. A read-only mount has
+// no upper directory: every write fails with EROFS.
 func OverlayMount(target string, src []string, ro bool) (Unmounter, error) {
 	var upper, work []string
+	var flag uintptr
+
+	if ro && len(src) == 1 {
+		// Overlayfs needs at least 2 lower directories without
+		// an upper one, a read-only bind mount is equivalent.
+		return BindMount(src[0], target, true)
+	}
 
 	if !ro {
 		// Create upper and work directories for writable mount
@@ -66,6 +125,8 @@ func OverlayMount(target string, src []string, ro bool) (Unmounter, error) {
 
 		upper = append(upper, upperDir)
 		work = append(work, workDir)
+	} else {
+		flag = syscall.MS_RDONLY
 	}
 
 	opt := formatOverlayFsMountOption(src, upper, work)
@@ -73,7 +134,7 @@ func OverlayMount(target string, src []string, ro bool) (Unmounter, error) {
 		Source: "none",
 		Target: target,
 		Type:   "overlay",
-		Flag:   0,
+		Flag:   flag,
 		Option: opt,
 	}
 
@@ -81,9 +142,13 @@ func OverlayMount(target string, src []string, ro bool) (Unmounter, error) {
 }
 
 // formatOverlayFsMountOption returns formatted overlayFS mount option.
+// Upper and work directories are omitted for a read-only mount.
 func formatOverlayFsMountOption(lowerDir, upperDir, workDir []string) string {
 	lower := "lowerdir="
 	lower += strings.Join(lowerDir, ":")
+	if len(upperDir) == 0 {
+		return lower
+	}
 	upper := "upperdir="
 	upper += strings.Join(upperDir, ":")
 	work := "workdir="
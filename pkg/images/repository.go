@@ -13,11 +13,16 @@ import (
 )
 
 var (
-	repositoryPath = filepath.Join(constants.KokerImagesPath, "repositories.json")
-	lock           = &sync.Mutex{}
-	imgRepo        repository
+	lock    = &sync.Mutex{}
+	imgRepo repository
 )
 
+// repositoryPath returns the image repository file. It is resolved
+// lazily as koker directories move in rootless mode.
+func repositoryPath() string {
+	return filepath.Join(constants.KokerImagesPath, "repositories.json")
+}
+
 func ListAllImages() ([]map[string]string, error) {
 	all := make([]map[string]string, 0)
 	for _, v := range imgRepo {
@@ -33,18 +38,18 @@ func ListAllImages() ([]map[string]string, error) {
 
 // LoadRepository creates image repository instance from file
 func LoadRepository() error {
-	log.Info().Str("repository", repositoryPath).Msg("Load image repository from file")
+	log.Info().Str("repository", repositoryPath()).Msg("Load image repository from file")
 	if imgRepo == nil {
 		lock.Lock()
 		defer lock.Unlock()
-		if _, err := os.Stat(repositoryPath); os.IsNotExist(err) {
-			os.WriteFile(repositoryPath, []byte("{}"), 0644)
+		if _, err := os.Stat(repositoryPath()); os.IsNotExist(err) {
+			os.WriteFile(repositoryPath(), []byte("{}"), 0644)
 			imgRepo = make(repository)
 			return nil
 		}
 
 		log.Debug().Msg("Load image repository")
-		data, err := os.ReadFile(repositoryPath)
+		data, err := os.ReadFile(repositoryPath())
 		if err != nil {
 			return errors.Wrap(err, "unable to load image repository")
 		}
@@ -69,7 +74,7 @@ func SaveRepository() error {
 	if err != nil {
 		return errors.Wrap(err, "unable to marshal image regsitry")
 	}
-	if err = os.WriteFile(repositoryPath, b, 0644); err != nil {
+	if err = os.WriteFile(repositoryPath(), b, 0644); err != nil {
 		return errors.Wrap(err, "unable to save repository to file")
 	}
 	return nil
@@ -0,0 +1,204 @@
+// Package landlock restricts the filesystem access of the container
+// command with a Landlock ruleset, see landlock(7).
+package landlock
+
+import (
+	"encoding/json"
+	"os"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// accessRights are the filesystem access rights by name, grouped
+// by the Landlock ABI version which introduced them
+var accessRights = map[string]uint64{
+	"execute":     unix.LANDLOCK_ACCESS_FS_EXECUTE,
+	"write_file":  unix.LANDLOCK_ACCESS_FS_WRITE_FILE,
+	"read_file":   unix.LANDLOCK_ACCESS_FS_READ_FILE,
+	"read_dir":    unix.LANDLOCK_ACCESS_FS_READ_DIR,
+	"remove_dir":  unix.LANDLOCK_ACCESS_FS_REMOVE_DIR,
+	"remove_file": unix.LANDLOCK_ACCESS_FS_REMOVE_FILE,
+	"make_char":   unix.LANDLOCK_ACCESS_FS_MAKE_CHAR,
+	"make_dir":    unix.LANDLOCK_ACCESS_FS_MAKE_DIR,
+	"make_reg":    unix.LANDLOCK_ACCESS_FS_MAKE_REG,
+	"make_sock":   unix.LANDLOCK_ACCESS_FS_MAKE_SOCK,
+	"make_fifo":   unix.LANDLOCK_ACCESS_FS_MAKE_FIFO,
+	"make_block":  unix.LANDLOCK_ACCESS_FS_MAKE_BLOCK,
+	"make_sym":    unix.LANDLOCK_ACCESS_FS_MAKE_SYM,
+	// ABI 2
+	"refer": unix.LANDLOCK_ACCESS_FS_REFER,
+	// ABI 3
+	"truncate": unix.LANDLOCK_ACCESS_FS_TRUNCATE,
+	// ABI 5
+	"ioctl_dev": unix.LANDLOCK_ACCESS_FS_IOCTL_DEV,
+}
+
+// accessGroups are shorthands for common access rights
+var accessGroups = map[string][]string{
+	"read": {"execute", "read_file", "read_dir"},
+	"write": {"write_file", "remove_dir", "remove_file", "make_char", "make_dir",
+		"make_reg", "make_sock", "make_fifo", "make_block", "make_sym", "refer", "truncate"},
+}
+
+// fileAccess are the access rights which apply to files, the
+// other ones only apply to directories
+const fileAccess = unix.LANDLOCK_ACCESS_FS_EXECUTE |
+	unix.LANDLOCK_ACCESS_FS_WRITE_FILE |
+	unix.LANDLOCK_ACCESS_FS_READ_FILE |
+	unix.LANDLOCK_ACCESS_FS_TRUNCATE |
+	unix.LANDLOCK_ACCESS_FS_IOCTL_DEV
+
+// Rule allows access to a path, and everything beneath it
+type Rule struct {
+	// Path inside the container root filesystem
+	Path string `json:"path"`
+	// Access rights, such as read_file or make_dir, or the read
+	// and write groups
+	Access []string `json:"access"`
+}
+
+// Profile lists the allowed filesystem accesses, any other is denied
+type Profile struct {
+	Rules []Rule `json:"rules"`
+}
+
+// LoadProfile reads and validates a JSON profile
+func LoadProfile(file string) (*Profile, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	p := new(Profile)
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, errors.Wrapf(err, "unable to parse landlock profile %s", file)
+	}
+	for _, r := range p.Rules {
+		if _, err := r.access(); err != nil {
+			return nil, errors.Wrapf(err, "invalid landlock profile %s", file)
+		}
+	}
+	return p, nil
+}
+
+// access returns the access rights of the rule
+func (r Rule) access() (uint64, error) {
+	if r.Path == "" {
+		return 0, errors.New("rule without path")
+	}
+	var access uint64
+	for _, name := range r.Access {
+		if group, ok := accessGroups[name]; ok {
+			for _, name := range group {
+				access |= accessRights[name]
+			}
+			continue
+		}
+		right, ok := accessRights[name]
+		if !ok {
+			return 0, errors.Errorf("unknown access right %q for %s", name, r.Path)
+		}
+		access |= right
+	}
+	return access, nil
+}
+
+// ABI returns the Landlock ABI version of the kernel, 0 when
+// Landlock isn't supported or is disabled
+func ABI() int {
+	abi, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, 0, 0,
+		unix.LANDLOCK_CREATE_RULESET_VERSION)
+	if errno != 0 {
+		return 0
+	}
+	return int(abi)
+}
+
+// handledAccess returns the access rights known by an ABI version
+func handledAccess(abi int) uint64 {
+	var access uint64 = unix.LANDLOCK_ACCESS_FS_MAKE_SYM<<1 - 1
+	if abi >= 2 {
+		access |= unix.LANDLOCK_ACCESS_FS_REFER
+	}
+	if abi >= 3 {
+		access |= unix.LANDLOCK_ACCESS_FS_TRUNCATE
+	}
+	if abi >= 5 {
+		access |= unix.LANDLOCK_ACCESS_FS_IOCTL_DEV
+	}
+	return access
+}
+
+// Ruleset creates the ruleset of the profile for an ABI version, rules
+// paths are resolved from the current root and ignored if they don't
+// exist. Access rights unknown to the ABI are dropped.
+func (p *Profile) Ruleset(abi int) (*os.File, error) {
+	handled := handledAccess(abi)
+	attr := unix.LandlockRulesetAttr{Access_fs: handled}
+	fd, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET,
+		uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return nil, errors.Wrap(errno, "unable to create landlock ruleset")
+	}
+	ruleset := os.NewFile(fd, "landlock-ruleset")
+
+	for _, r := range p.Rules {
+		if err := addRule(ruleset, r, handled); err != nil {
+			ruleset.Close()
+			return nil, err
+		}
+	}
+	return ruleset, nil
+}
+
+// addRule adds a path beneath rule to the ruleset
+func addRule(ruleset *os.File, r Rule, handled uint64) error {
+	access, err := r.access()
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(r.Path, unix.O_PATH|unix.O_CLOEXEC, 0)
+	if os.IsNotExist(err) {
+		// Nothing to allow access to
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "unable to open landlock rule path")
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	access &= handled
+	if !info.IsDir() {
+		access &= fileAccess
+	}
+	if access == 0 {
+		// None of the rights is handled, the rule is rejected otherwise
+		return nil
+	}
+
+	attr := unix.LandlockPathBeneathAttr{Allowed_access: access, Parent_fd: int32(f.Fd())}
+	if _, _, errno := unix.Syscall6(unix.SYS_LANDLOCK_ADD_RULE, ruleset.Fd(),
+		unix.LANDLOCK_RULE_PATH_BENEATH, uintptr(unsafe.Pointer(&attr)), 0, 0, 0); errno != 0 {
+		return errors.Wrapf(errno, "unable to add landlock rule for %s", r.Path)
+	}
+	return nil
+}
+
+// RestrictSelf enforces the ruleset on the calling thread, and the
+// processes it starts. It can't be undone, the thread should be locked
+// and discarded.
+func RestrictSelf(ruleset *os.File) error {
+	// Required to restrict ourselves without CAP_SYS_ADMIN, and so that
+	// the restriction can't be escaped through set-user-ID programs.
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return errors.Wrap(err, "unable to set no_new_privs")
+	}
+	if _, _, errno := unix.Syscall(unix.SYS_LANDLOCK_RESTRICT_SELF, ruleset.Fd(), 0, 0); errno != 0 {
+		return errors.Wrap(errno, "unable to enforce landlock ruleset")
+	}
+	return nil
+}
@@ -148,6 +148,28 @@ func LinkRename(old, new string) error {
 	return netlink.LinkSetName(link, new)
 }
 
+// LinkHardwareAddr returns the MAC address of the link device
+func LinkHardwareAddr(linkName string) (string, error) {
+	link, err := netlink.LinkByName(linkName)
+	if err != nil {
+		return "", err
+	}
+	return link.Attrs().HardwareAddr.String(), nil
+}
+
+// LinkStatistics returns the bytes received and transmitted by the link device
+func LinkStatistics(linkName string) (rx, tx uint64, err error) {
+	link, err := netlink.LinkByName(linkName)
+	if err != nil {
+		return 0, 0, err
+	}
+	stats := link.Attrs().Statistics
+	if stats == nil {
+		return 0, 0, errors.Errorf("no statistics for %s", linkName)
+	}
+	return stats.RxBytes, stats.TxBytes, nil
+}
+
 // IPExists checks IP is used or not
 func IPExists(ip net.IP) (bool, error) {
 	log.Debug().Str("ip", ip.String()).Msg("Check IP exists")
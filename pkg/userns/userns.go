@@ -0,0 +1,229 @@
+package userns
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+
+	"github.com/ntk148v/koker/pkg/constants"
+	"github.com/ntk148v/koker/pkg/reexec"
+)
+
+// syncEnv tells the child which file descriptor to read until
+// its uid/gid mappings are written by newuidmap/newgidmap.
+const syncEnv = "_KOKER_USERNS_SYNC"
+
+// Rootless reports whether koker runs without real root privileges,
+// either as an unprivileged user or inside a user namespace created
+// by an unprivileged user.
+func Rootless() bool {
+	if os.Geteuid() != 0 {
+		return true
+	}
+	return inUserNS()
+}
+
+// inUserNS checks /proc/self/uid_map. The initial user namespace
+// maps the full uid range, any other mapping means that we are
+// running in a child user namespace.
+func inUserNS() bool {
+	data, err := os.ReadFile("/proc/self/uid_map")
+	if err != nil {
+		return false
+	}
+	fields := strings.Fields(string(data))
+	return !(len(fields) == 3 && fields[0] == "0" && fields[1] == "0" &&
+		fields[2] == "4294967295")
+}
+
+// DataHome returns the per-user state root: $XDG_DATA_HOME/koker,
+// $HOME/.local/share/koker when XDG_DATA_HOME isn't set.
+func DataHome() (string, error) {
+	if dataHome := os.Getenv("XDG_DATA_HOME"); dataHome != "" {
+		return filepath.Join(dataHome, constants.KokerApp), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", errors.Wrap(err, "unable to find user's home directory")
+	}
+	return filepath.Join(home, ".local", "share", constants.KokerApp), nil
+}
+
+// IDMappings returns uid and gid mappings for a new user namespace.
+// The current user is always mapped to root. If the user owns
+// subordinate ids (/etc/subuid, /etc/subgid) and newuidmap/newgidmap
+// are installed, these ids are mapped right after root and helper
+// is true: the mappings have to be written with WriteIDMappings.
+func IDMappings() (uidMaps, gidMaps []syscall.SysProcIDMap, helper bool) {
+	uid, gid := os.Getuid(), os.Getgid()
+	uidMaps = []syscall.SysProcIDMap{{ContainerID: 0, HostID: uid, Size: 1}}
+	gidMaps = []syscall.SysProcIDMap{{ContainerID: 0, HostID: gid, Size: 1}}
+
+	if _, err := exec.LookPath("newuidmap"); err != nil {
+		return
+	}
+	if _, err := exec.LookPath("newgidmap"); err != nil {
+		return
+	}
+	subUID, err := subIDRange("/etc/subuid")
+	if err != nil {
+		log.Debug().Err(err).Msg("No subordinate uids, map current user only")
+		return
+	}
+	subGID, err := subIDRange("/etc/subgid")
+	if err != nil {
+		log.Debug().Err(err).Msg("No subordinate gids, map current user only")
+		return
+	}
+	subUID.ContainerID, subGID.ContainerID = 1, 1
+	uidMaps = append(uidMaps, subUID)
+	gidMaps = append(gidMaps, subGID)
+	return uidMaps, gidMaps, true
+}
+
+// subIDRange returns the first range of the current user in a
+// subordinate id file. Entries may use the user name or the uid.
+func subIDRange(file string) (syscall.SysProcIDMap, error) {
+	var idMap syscall.SysProcIDMap
+	names := []string{strconv.Itoa(os.Getuid())}
+	if u, err := user.Current(); err == nil {
+		names = append(names, u.Username)
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return idMap, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Format: name:start:count
+		parts := strings.Split(strings.TrimSpace(scanner.Text()), ":")
+		if len(parts) != 3 {
+			continue
+		}
+		for _, name := range names {
+			if parts[0] != name {
+				continue
+			}
+			start, err := strconv.Atoi(parts[1])
+			if err != nil {
+				return idMap, errors.Wrapf(err, "invalid entry in %s", file)
+			}
+			count, err := strconv.Atoi(parts[2])
+			if err != nil {
+				return idMap, errors.Wrapf(err, "invalid entry in %s", file)
+			}
+			idMap.HostID, idMap.Size = start, count
+			return idMap, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return idMap, err
+	}
+	return idMap, errors.Errorf("no entry for current user in %s", file)
+}
+
+// WriteIDMappings writes uid and gid mappings of process pid using the
+// setuid newuidmap/newgidmap helpers.
+func WriteIDMappings(pid int, uidMaps, gidMaps []syscall.SysProcIDMap) error {
+	log.Debug().Int("pid", pid).Msg("Write uid/gid mappings with newuidmap/newgidmap")
+	if err := runIDMapHelper("newuidmap", pid, uidMaps); err != nil {
+		return err
+	}
+	return runIDMapHelper("newgidmap", pid, gidMaps)
+}
+
+func runIDMapHelper(helper string, pid int, idMaps []syscall.SysProcIDMap) error {
+	args := []string{strconv.Itoa(pid)}
+	for _, m := range idMaps {
+		args = append(args, strconv.Itoa(m.ContainerID), strconv.Itoa(m.HostID),
+			strconv.Itoa(m.Size))
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command(helper, args...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return errors.Wrapf(err, "%s failed: %s", helper, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// Start starts cmd in a new user namespace where the current user is root.
+// Without newuidmap/newgidmap, the mappings are written by the Go runtime
+// before the child executes. Otherwise the child blocks in WaitForMappings
+// until the helpers are done.
+func Start(cmd *exec.Cmd) error {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWUSER
+	uidMaps, gidMaps, helper := IDMappings()
+	if !helper {
+		log.Debug().Msg("Map current user to root in the user namespace")
+		cmd.SysProcAttr.UidMappings = uidMaps
+		cmd.SysProcAttr.GidMappings = gidMaps
+		return cmd.Start()
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	cmd.ExtraFiles = append(cmd.ExtraFiles, r)
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	// ExtraFiles start right after stdin, stdout and stderr
+	cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%d", syncEnv, 2+len(cmd.ExtraFiles)))
+	err = cmd.Start()
+	r.Close()
+	if err != nil {
+		return err
+	}
+
+	if err := WriteIDMappings(cmd.Process.Pid, uidMaps, gidMaps); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	return nil
+}
+
+// WaitForMappings must be called first thing in a child started by Start.
+// It waits until the parent has written the uid/gid mappings, then re-executes
+// the current binary: capabilities are computed at execve, and the first
+// execve happened while we weren't root in the namespace yet.
+func WaitForMappings() error {
+	fdStr := os.Getenv(syncEnv)
+	if fdStr == "" {
+		return nil
+	}
+	fd, err := strconv.Atoi(fdStr)
+	if err != nil {
+		return errors.Wrapf(err, "invalid %s", syncEnv)
+	}
+	pipe := os.NewFile(uintptr(fd), "userns-sync")
+	// The parent closes its end once mappings are written
+	if _, err := io.Copy(io.Discard, pipe); err != nil {
+		return errors.Wrap(err, "unable to wait for uid/gid mappings")
+	}
+	pipe.Close()
+	os.Unsetenv(syncEnv)
+
+	log.Debug().Msg("Re-execute in the user namespace to gain capabilities")
+	return syscall.Exec(reexec.Self(), os.Args, os.Environ())
+}
@@ -3,6 +3,7 @@ package utils
 import (
 	"archive/tar"
 	"compress/gzip"
+	"encoding/json"
 	"fmt"
 	"io"
 	"math/rand"
@@ -74,6 +75,17 @@ func CopyFile(src, dst string) error {
 	return nil
 }
 
+// extractPath returns where an archive entry is extracted in target,
+// entries which would be outside are rejected
+func extractPath(target, name string) (string, error) {
+	path := filepath.Join(target, name)
+	rel, err := filepath.Rel(target, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", errors.Errorf("archive entry %q is outside of the target directory", name)
+	}
+	return path, nil
+}
+
 // Extract untars both .tar and .tar.gz files.
 func Extract(tarball, target string) error {
 	reader, err := os.Open(tarball)
@@ -95,6 +107,8 @@ func Extract(tarball, target string) error {
 		tarReader = tar.NewReader(reader)
 	}
 
+	// Hard links are created last, once all their targets are extracted
+	var links [][2]string
 	for {
 		header, err := tarReader.Next()
 		if err == io.EOF {
@@ -103,8 +117,17 @@ func Extract(tarball, target string) error {
 			return err
 		}
 
-		path := filepath.Join(target, header.Name)
+		path, err := extractPath(target, header.Name)
+		if err != nil {
+			return err
+		}
 		info := header.FileInfo()
+		if header.Typeflag != tar.TypeDir {
+			// Archives may not have entries for every directory
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+		}
 
 		switch header.Typeflag {
 		case tar.TypeDir:
@@ -117,25 +140,30 @@ func Extract(tarball, target string) error {
 			if err != nil {
 				return err
 			}
-			defer file.Close()
 			_, err = io.Copy(file, tarReader)
+			file.Close()
 			if err != nil {
 				return err
 			}
 		case tar.TypeLink:
-			link := filepath.Join(target, header.Name)
-			linkTarget := filepath.Join(target, header.Linkname)
-			// lazy link creation. just to make sure all files are available
-			defer os.Link(link, linkTarget)
+			linkTarget, err := extractPath(target, header.Linkname)
+			if err != nil {
+				return err
+			}
+			links = append(links, [2]string{linkTarget, path})
 		case tar.TypeSymlink:
-			linkPath := filepath.Join(target, header.Name)
-			if err := os.Symlink(header.Linkname, linkPath); err != nil {
+			if err := os.Symlink(header.Linkname, path); err != nil {
 				if !os.IsExist(err) {
 					return err
 				}
 			}
 		}
 	}
+	for _, link := range links {
+		if err := os.Link(link[0], link[1]); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -167,6 +195,36 @@ func GenTemplate(name, tempStr string, input any) error {
 	return temp.Execute(os.Stdout, input)
 }
 
+// FormatTemplate executes a user supplied template, --format, on input.
+// The json function formats a value as JSON.
+func FormatTemplate(tempStr string, input any) error {
+	temp, err := template.New("format").Funcs(template.FuncMap{
+		"json": func(v any) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}).Parse(tempStr)
+	if err != nil {
+		return errors.Wrap(err, "invalid format")
+	}
+	if err := temp.Execute(os.Stdout, input); err != nil {
+		return err
+	}
+	fmt.Println()
+	return nil
+}
+
+// HumanSize formats a size in bytes with binary units, such as 1.5MiB
+func HumanSize(size uint64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB"}
+	value, i := float64(size), 0
+	for value >= 1024 && i < len(units)-1 {
+		value /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.4g%s", value, units[i])
+}
+
 // SetNamespace calls setns syscall for set of flags. It changes
 // current process namespace to namespace of another process which
 // can be specified by pid.
@@ -189,12 +247,15 @@ func SetNamespace(pid string, flag int) error {
 		if flag&k == 0 {
 			continue
 		}
-		nsFile, err := os.Open(filepath.Join(nsBase, v))
+		nsPath := filepath.Join(nsBase, v)
+		nsFile, err := os.Open(nsPath)
 		if err != nil {
-			return errors.Wrapf(err, "can't open %s", nsFile)
+			return errors.Wrapf(err, "can't open %s", nsPath)
 		}
 
-		if err := unix.Setns(int(nsFile.Fd()), k); err != nil {
+		err = unix.Setns(int(nsFile.Fd()), k)
+		nsFile.Close()
+		if err != nil {
 			return errors.Wrapf(err, "can't setns to %s", v)
 		}
 	}